@@ -1,16 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
@@ -25,10 +34,22 @@ import (
 
 	"go.uber.org/zap"
 
+	"repos.se/minio-deduplication/v2/pkg/admin"
+	"repos.se/minio-deduplication/v2/pkg/amqp"
 	"repos.se/minio-deduplication/v2/pkg/bucket"
+	"repos.se/minio-deduplication/v2/pkg/health"
 	"repos.se/minio-deduplication/v2/pkg/index"
 	"repos.se/minio-deduplication/v2/pkg/kafka"
+	"repos.se/minio-deduplication/v2/pkg/listener"
 	"repos.se/minio-deduplication/v2/pkg/metadata"
+	"repos.se/minio-deduplication/v2/pkg/nats"
+	"repos.se/minio-deduplication/v2/pkg/policy"
+	"repos.se/minio-deduplication/v2/pkg/polling"
+	"repos.se/minio-deduplication/v2/pkg/query"
+	"repos.se/minio-deduplication/v2/pkg/redis"
+	"repos.se/minio-deduplication/v2/pkg/scan"
+	"repos.se/minio-deduplication/v2/pkg/sequencer"
+	"repos.se/minio-deduplication/v2/pkg/webhook"
 )
 
 type uploaded struct {
@@ -40,29 +61,105 @@ const (
 	emptyFileSha256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
 )
 
+// errShutdown is returned from mainMinio when processing stopped on signal
+var errShutdown = errors.New("shutdown requested")
+
 var (
-	inbox                   string
-	archive                 string
-	host                    string
-	secure                  bool
-	accesskey               string
-	secretkey               string
-	metrics                 string
-	trace                   bool
-	batch                   bool
-	batchmetrics            bool
-	batchmetricsWaitMax     = time.Duration(time.Minute * 1)
-	restartDelay            time.Duration
-	dropEmptyFiles          bool
-	indexNext               *index.Index
-	indexWrite              bool
-	indexWriteDir           = "deduplication-index"
-	indexType               = "application/jsonlines"
-	kafkaBootstrap          = os.Getenv("KAFKA_BOOTSTRAP")
-	kafkaTopic              = os.Getenv("KAFKA_TOPIC")
-	kafkaConsumerGroup      = os.Getenv("KAFKA_CONSUMER_GROUP")
-	kafkaFetchMaxWait       = os.Getenv("KAFKA_FETCH_MAX_WAIT")
-	kafkaFetchMaxWaiDefault = time.Duration(time.Second * 1) // Default is 5 s which will keep users waiting quite a bit, https://github.com/twmb/franz-go/blob/v1.11.0/pkg/kgo/config.go#L1096
+	inbox                    string
+	archive                  string
+	host                     string
+	secure                   bool
+	accesskey                string
+	secretkey                string
+	metrics                  string
+	trace                    bool
+	batch                    bool
+	batchmetrics             bool
+	batchmetricsWaitMax      = time.Duration(time.Minute * 1)
+	restartDelay             time.Duration
+	transferAttempts         int
+	workers                  int
+	sequencerCacheSize       int
+	sequencerCacheFile       string
+	sequencers               *sequencer.Cache
+	replay                   bool
+	replayFrom               string
+	replayOffsets            string
+	replayDryRun             bool
+	events                   string
+	eventTypes               map[string]bool
+	laneBuffer               = 10
+	shutdownTimeout          time.Duration
+	dropEmptyFiles           bool
+	includeKeys              []string
+	excludeKeys              []string
+	excludeAction            string
+	keyPolicy                *policy.KeyPolicy
+	minSize                  int64
+	maxSize                  int64
+	sizeAction               string
+	sizePolicy               *policy.SizePolicy
+	allowTypes               []string
+	contentAction            string
+	contentPolicy            *policy.ContentPolicy
+	quarantine               string
+	clamdAddress             string
+	clamdTimeout             time.Duration
+	scanner                  *scan.Clamd
+	indexNext                *index.Index
+	indexWrite               bool
+	indexWriteDir            = "deduplication-index"
+	indexWriteMu             sync.Mutex
+	indexFlushEntries        = 10000
+	indexType                = "application/jsonlines"
+	queryApi                 bool
+	queryCacheTtl            time.Duration
+	queryCacheMax            = 10000
+	adminToken               = os.Getenv("ADMIN_TOKEN")
+	control                  = admin.NewControl()
+	stallAfter               time.Duration
+	silentAfter              time.Duration
+	healthCheck              *health.Health
+	listenActivity           = &listener.Activity{}
+	kafkaBootstrap           = os.Getenv("KAFKA_BOOTSTRAP")
+	kafkaTopic               = os.Getenv("KAFKA_TOPIC")
+	kafkaConsumerGroup       = os.Getenv("KAFKA_CONSUMER_GROUP")
+	kafkaFetchMaxWait        = os.Getenv("KAFKA_FETCH_MAX_WAIT")
+	kafkaFetchMaxWaiDefault  = time.Duration(time.Second * 1) // Default is 5 s which will keep users waiting quite a bit, https://github.com/twmb/franz-go/blob/v1.11.0/pkg/kgo/config.go#L1096
+	kafkaCommitInterval      = os.Getenv("KAFKA_COMMIT_INTERVAL")
+	kafkaCommitBatch         = os.Getenv("KAFKA_COMMIT_BATCH")
+	kafkaResultsTopic        = os.Getenv("KAFKA_RESULTS_TOPIC")
+	kafkaDeadLetterTopic     = os.Getenv("KAFKA_DEAD_LETTER_TOPIC")
+	amqpUrl                  = os.Getenv("AMQP_URL")
+	amqpQueue                = os.Getenv("AMQP_QUEUE")
+	amqpExchange             = os.Getenv("AMQP_EXCHANGE")
+	amqpRoutingKey           = os.Getenv("AMQP_ROUTING_KEY")
+	amqpExchangeType         = os.Getenv("AMQP_EXCHANGE_TYPE")
+	amqpDeadLetterExchange   = os.Getenv("AMQP_DEAD_LETTER_EXCHANGE")
+	amqpPrefetch             = os.Getenv("AMQP_PREFETCH")
+	natsUrl                  = os.Getenv("NATS_URL")
+	natsStream               = os.Getenv("NATS_STREAM")
+	natsSubject              = os.Getenv("NATS_SUBJECT")
+	natsDurable              = getenvDefault("NATS_DURABLE", "minio-deduplication")
+	natsNakDelay             = os.Getenv("NATS_NAK_DELAY")
+	redisUrl                 = os.Getenv("REDIS_URL")
+	redisStream              = os.Getenv("REDIS_STREAM")
+	redisGroup               = getenvDefault("REDIS_GROUP", "minio-deduplication")
+	redisConsumer            = getenvDefault("REDIS_CONSUMER", os.Getenv("HOST"))
+	redisField               = os.Getenv("REDIS_FIELD")
+	redisList                = os.Getenv("REDIS_LIST")
+	redisClaimIdle           = os.Getenv("REDIS_CLAIM_IDLE")
+	webhookReceiverToken     = os.Getenv("WEBHOOK_RECEIVER_TOKEN")
+	webhookReceiverWait      = os.Getenv("WEBHOOK_RECEIVER_WAIT")
+	webhookReceiver          *webhook.Receiver
+	pollInterval             = os.Getenv("POLL_INTERVAL")
+	pollMinAge               = os.Getenv("POLL_MIN_AGE")
+	webhookUrl               = os.Getenv("WEBHOOK_URL")
+	webhookSecret            = os.Getenv("WEBHOOK_SECRET")
+	webhookQueueDir          = os.Getenv("WEBHOOK_QUEUE_DIR")
+	webhookMaxElapsed        = os.Getenv("WEBHOOK_MAX_ELAPSED")
+	webhookMaxElapsedDefault = time.Duration(time.Second * 10)
+	transferSinks            []bucket.TransferSink
 
 	ignoredUnexpectedBucket = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "blobs_ignored_unexpected_bucket",
@@ -71,7 +168,7 @@ var (
 	transfersStarted = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "blobs_transfers_initiated",
-			Help: "The number of transfers started, by trigger method",
+			Help: "The number of transfers started, by trigger method, which is the event name for notifications",
 		},
 		[]string{"trigger"},
 	)
@@ -79,6 +176,19 @@ var (
 		Name: "blobs_transfers_completed",
 		Help: "The number of copy operations that completed without errors",
 	})
+	transfersRetried = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "blobs_transfers_retried",
+		Help: "The number of transfer attempts that were retries after a failure",
+	})
+	archiveLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "blobs_archive_latency_seconds",
+		Help:    "From the notification's S3 eventTime to the end of the transfer, by outcome",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 14),
+	}, []string{"outcome"})
+	notificationsNoop = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blobs_notifications_noop",
+		Help: "Notification records acked without a transfer, by reason redelivered, gone from inbox or event type not configured",
+	}, []string{"reason"})
 	duplicates = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "blobs_duplicates",
 		Help: "How many times a destination object existed (we still try to update metadata)",
@@ -97,9 +207,106 @@ func init() {
 	flag.BoolVar(&batch, "batch", false, "Run in batch mode: list + transfer then exit")
 	flag.BoolVar(&batchmetrics, "batchmetrics", false, "Wait for metrics scrape after batch run")
 	flag.DurationVar(&restartDelay, "restartdelay", time.Duration(time.Second*1), "On error restart after sleep, zero to disable restart")
-	flag.BoolVar(&indexWrite, "index", false, "Write index files to archive /minio-deduplication-index/*")
+	flag.IntVar(&transferAttempts, "transferattempts", 3, "Attempts per transfer before it's reported as failed, with backoff in between")
+	flag.IntVar(&workers, "workers", 1, "Notifications processed concurrently, in lanes that keep the order per upload key")
+	flag.IntVar(&sequencerCacheSize, "sequencercache", 10000, "Completed notification sequencers to remember, to ack redeliveries as no-ops")
+	flag.StringVar(&events, "events", strings.Join(defaultEvents, ","), "Comma separated s3:ObjectCreated:* event names to transfer, for the standalone listener's subscription and to filter notifications from other sources")
+	flag.StringVar(&sequencerCacheFile, "sequencercachefile", "", "Persist the sequencer cache to this file, to detect redeliveries across restarts")
+	flag.DurationVar(&shutdownTimeout, "shutdowntimeout", time.Duration(time.Second*25), "On SIGTERM wait this long for in-flight transfers before exiting anyway")
+	flag.BoolVar(&indexWrite, "index", false, "Write index files to archive /minio-deduplication-index/* at batch completion or shutdown")
 	flag.BoolVar(&dropEmptyFiles, "dropempty", false, "Drops empty files (deletes them from inbox)")
-	flag.Parse()
+	flag.Func("include", "Only process upload keys that match, a glob or regex:pattern, repeatable", func(value string) error {
+		includeKeys = append(includeKeys, value)
+		return nil
+	})
+	flag.Func("exclude", "Don't process upload keys that match, a glob or regex:pattern, repeatable. Globs without a slash match the file name.", func(value string) error {
+		excludeKeys = append(excludeKeys, value)
+		return nil
+	})
+	flag.StringVar(&excludeAction, "excludeaction", string(policy.ActionLeave), "What to do with excluded uploads: leave, drop or quarantine")
+	flag.Int64Var(&minSize, "minsize", 0, "Reject uploads smaller than this many bytes, checked before they're read, 0 for no limit")
+	flag.Int64Var(&maxSize, "maxsize", 0, "Reject uploads larger than this many bytes, checked before they're read, 0 for no limit")
+	flag.StringVar(&sizeAction, "sizeaction", string(policy.ActionLeave), "What to do with uploads outside --minsize and --maxsize: leave, drop or quarantine")
+	flag.Func("allowtype", "Only archive uploads with this declared content type, type/subtype or type/*, and content that doesn't contradict it, repeatable", func(value string) error {
+		allowTypes = append(allowTypes, value)
+		return nil
+	})
+	flag.StringVar(&contentAction, "contentaction", string(policy.ActionLeave), "What to do with uploads rejected by --allowtype: leave, drop or quarantine")
+	flag.StringVar(&quarantine, "quarantine", "", "Bucket that quarantined uploads are moved to, with their upload key")
+	flag.StringVar(&clamdAddress, "clamd", "", "Scan uploads with clamd at tcp://host:3310 or unix:///path/to/clamd.sock while hashing, and quarantine infected ones. Requires --quarantine.")
+	flag.DurationVar(&clamdTimeout, "clamdtimeout", time.Duration(time.Minute), "Fail a transfer if clamd doesn't respond for this long")
+	flag.BoolVar(&queryApi, "query", false, "Serve the blob query API /blobs/{sha256} and /resolve on the metrics server")
+	flag.DurationVar(&stallAfter, "stallafter", time.Duration(time.Minute*10), "Fail /healthz if a transfer has been in flight for longer than this")
+	flag.DurationVar(&silentAfter, "silentafter", time.Duration(time.Minute*1), "Fail /healthz if the notification source has been out of contact for longer than this")
+	flag.DurationVar(&queryCacheTtl, "querycachettl", time.Duration(time.Minute), "How long the query API caches blob lookups")
+	flag.StringVar(&replayFrom, "from", "", "replay: start at the first notification at or after this RFC3339 time, on all partitions")
+	flag.StringVar(&replayOffsets, "offsets", "", "replay: start at topic:partition:offset items, comma separated, instead of --from")
+	flag.BoolVar(&replayDryRun, "dryrun", false, "replay: report uploads that would be transferred, without transferring")
+}
+
+// parseFlags is called from main, not init, so that tests can run with their own flags
+func parseFlags() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay = true
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+}
+
+// defaultEvents are those ObjectCreated types that are uploads, unlike for example s3:ObjectCreated:PutTagging
+var defaultEvents = []string{
+	"s3:ObjectCreated:Put",
+	"s3:ObjectCreated:Post",
+	"s3:ObjectCreated:Copy",
+	"s3:ObjectCreated:CompleteMultipartUpload",
+}
+
+// parseEvents is fatal for event names that aren't ObjectCreated, as we only transfer uploads
+func parseEvents(logger *zap.Logger) map[string]bool {
+	parsed := make(map[string]bool)
+	for _, name := range strings.Split(events, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !strings.HasPrefix(name, "s3:ObjectCreated:") || name == "s3:ObjectCreated:*" {
+			logger.Fatal("Events must be s3:ObjectCreated: types, listed explicitly", zap.String("event", name))
+		}
+		parsed[name] = true
+	}
+	if len(parsed) == 0 {
+		logger.Fatal("At least one event type is required", zap.String("events", events))
+	}
+	return parsed
+}
+
+// eventNames is the sorted configured event types
+func eventNames() []string {
+	names := make([]string, 0, len(eventTypes))
+	for name := range eventTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// notificationTrigger is the transfer trigger for a notification record, its event name unless it's synthetic
+func notificationTrigger(record notification.Event) string {
+	if record.EventSource == polling.EventSource {
+		return "listing"
+	}
+	if record.EventName == "" {
+		return "notification"
+	}
+	return record.EventName
+}
+
+func getenvDefault(name, value string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return value
 }
 
 func getConsumerGroupName(logger *zap.Logger) string {
@@ -120,6 +327,15 @@ func getConsumerGroupName(logger *zap.Logger) string {
 	return host
 }
 
+// getKafkaAuth reads KAFKA_AUTH_CONFIG, KAFKA_SASL_* and KAFKA_TLS_* for consumer and producer alike
+func getKafkaAuth(logger *zap.Logger) *kafka.KafkaAuthConfig {
+	auth, err := kafka.LoadKafkaAuth(os.Getenv)
+	if err != nil {
+		logger.Fatal("Failed to read kafka auth config", zap.Error(err))
+	}
+	return auth
+}
+
 func assertBucketExists(ctx context.Context, name string, minioClient *minio.Client, logger *zap.Logger) {
 	check := func() error {
 		found, err := minioClient.BucketExists(ctx, name)
@@ -146,52 +362,240 @@ func assertBucketExists(ctx context.Context, name string, minioClient *minio.Cli
 	}
 }
 
-func transfer(ctx context.Context, blob uploaded, minioClient *minio.Client, logger *zap.Logger) {
+// reject handles an upload that a policy rejected, instead of transferring it
+func reject(ctx context.Context, blob uploaded, action policy.Action, reason string, minioClient *minio.Client, logger *zap.Logger) *bucket.TransferEvent {
+	switch action {
+	case policy.ActionLeave:
+		logger.Info("Leaving upload in inbox", zap.String("key", blob.Key), zap.String("reason", reason))
+		indexNext.AppendRejected(blob.Key, index.KindLeft, reason, nil)
+		return &bucket.TransferEvent{
+			Outcome: bucket.OutcomeIgnored,
+			Upload:  blob.Key,
+			Reason:  reason,
+			Time:    time.Now().UTC(),
+		}
+	case policy.ActionQuarantine:
+		return quarantineUpload(ctx, blob, "", reason, nil, minioClient, logger)
+	}
+	if err := minioClient.RemoveObject(ctx, inbox, blob.Key, minio.RemoveObjectOptions{}); err != nil {
+		logger.Error("Failed to remove rejected upload. Inbox item probably still exists.",
+			zap.String("key", blob.Key),
+			zap.String("bucket", inbox),
+			zap.Error(err),
+		)
+		return transferFailed(blob, err)
+	}
+	logger.Info("Dropped upload", zap.String("key", blob.Key), zap.String("reason", reason))
+	indexNext.AppendRejected(blob.Key, index.KindDropped, reason, nil)
+	return &bucket.TransferEvent{
+		Outcome: bucket.OutcomeDropped,
+		Upload:  blob.Key,
+		Reason:  reason,
+		Time:    time.Now().UTC(),
+	}
+}
+
+// quarantineUpload copies the upload to the quarantine bucket with the same key, then removes it from the inbox.
+// Extra is added to the metadata, such as scan results.
+// A non-empty etag is the upload that was read, such as for a scan, and if the upload has changed since it's failed for a retry.
+func quarantineUpload(ctx context.Context, blob uploaded, etag string, reason string, extra map[string]string, minioClient *minio.Client, logger *zap.Logger) *bucket.TransferEvent {
 	objectInfo, err := minioClient.StatObject(ctx, inbox, blob.Key, minio.StatObjectOptions{})
+	if err != nil && minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return &bucket.TransferEvent{
+			Outcome: bucket.OutcomeGone,
+			Upload:  blob.Key,
+			Time:    time.Now().UTC(),
+		}
+	}
 	if err != nil {
-		// NOTE with kafka notifications we currently use the default commit behavior
-		// https://github.com/twmb/franz-go/blob/master/docs/producing-and-consuming.md#consumer-groups
+		logger.Error("Failed to stat upload to quarantine", zap.String("key", blob.Key), zap.Error(err))
+		return transferFailed(blob, err)
+	}
+	if etag != "" && objectInfo.ETag != etag {
+		logger.Warn("Upload changed before quarantine", zap.String("key", blob.Key), zap.String("etag", etag))
+		return transferFailed(blob, fmt.Errorf("upload etag %s changed to %s before quarantine", etag, objectInfo.ETag))
+	}
+	meta := metadata.NewMetadataQuarantine(objectInfo, reason)
+	for k, v := range extra {
+		meta.UserMetadata[k] = v
+	}
+	_, err = minioClient.CopyObject(ctx, minio.CopyDestOptions{
+		Bucket:          quarantine,
+		Object:          blob.Key,
+		UserMetadata:    meta.UserMetadata,
+		ReplaceMetadata: meta.ReplaceMetadata,
+	}, minio.CopySrcOptions{
+		Bucket:    inbox,
+		Object:    blob.Key,
+		MatchETag: objectInfo.ETag,
+	})
+	if err != nil {
+		logger.Error("Failed to quarantine",
+			zap.String("key", blob.Key),
+			zap.String("quarantine", quarantine),
+			zap.Error(err),
+		)
+		return transferFailed(blob, err)
+	}
+	if err := minioClient.RemoveObject(ctx, inbox, blob.Key, minio.RemoveObjectOptions{}); err != nil {
+		logger.Error("Failed to remove quarantined upload. Inbox item probably still exists.",
+			zap.String("key", blob.Key),
+			zap.String("bucket", inbox),
+			zap.Error(err),
+		)
+		return transferFailed(blob, err)
+	}
+	logger.Warn("Quarantined upload", zap.String("key", blob.Key), zap.String("reason", reason))
+	indexNext.AppendRejected(blob.Key, index.KindQuarantined, reason, meta.UserMetadata)
+	return &bucket.TransferEvent{
+		Outcome: bucket.OutcomeQuarantined,
+		Upload:  blob.Key,
+		Meta:    meta.UserMetadata,
+		Reason:  reason,
+		Time:    time.Now().UTC(),
+	}
+}
+
+func transferFailed(blob uploaded, err error) *bucket.TransferEvent {
+	return &bucket.TransferEvent{
+		Outcome: bucket.OutcomeFailed,
+		Upload:  blob.Key,
+		Error:   err.Error(),
+		Time:    time.Now().UTC(),
+	}
+}
+
+// transfer returns the outcome, which is failed for storage errors that a retry might recover from
+func transfer(ctx context.Context, blob uploaded, minioClient *minio.Client, logger *zap.Logger) *bucket.TransferEvent {
+	if reason := keyPolicy.Check(blob.Key); reason != "" {
+		return reject(ctx, blob, keyPolicy.Action, reason, minioClient, logger)
+	}
+	objectInfo, err := minioClient.StatObject(ctx, inbox, blob.Key, minio.StatObjectOptions{})
+	if err != nil && minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		logger.Info("Upload already gone from inbox",
+			zap.String("key", blob.Key),
+			zap.String("bucket", inbox),
+		)
+		return &bucket.TransferEvent{
+			Outcome: bucket.OutcomeGone,
+			Upload:  blob.Key,
+			Time:    time.Now().UTC(),
+		}
+	}
+	if err != nil {
+		// NOTE with kafka notifications offsets are committed after ack,
 		// which means that it's likely after unclean exit that transfers happend but commit did not.
-		// The risk would be present but lower with commit immediately upon transfer.
-		logger.Fatal("Failed to stat source object",
+		logger.Error("Failed to stat source object",
 			zap.String("key", blob.Key),
 			zap.String("bucket", inbox),
 			zap.Error(err),
 		)
+		return transferFailed(blob, err)
+	}
+	if reason := sizePolicy.Check(objectInfo.Size); reason != "" {
+		return reject(ctx, blob, sizePolicy.Action, reason, minioClient, logger)
 	}
 
-	object, err := minioClient.GetObject(ctx, inbox, blob.Key, minio.GetObjectOptions{})
+	// the content that's hashed, scanned and copied must be the one that was stat'ed, or a retry gets the new upload
+	getOptions := minio.GetObjectOptions{}
+	if err := getOptions.SetMatchETag(objectInfo.ETag); err != nil {
+		return transferFailed(blob, err)
+	}
+	object, err := minioClient.GetObject(ctx, inbox, blob.Key, getOptions)
 	if err != nil {
-		logger.Fatal("Failed to read source object",
+		logger.Error("Failed to read source object",
 			zap.String("key", blob.Key),
 			zap.String("bucket", inbox),
 			zap.Error(err),
 		)
+		return transferFailed(blob, err)
 	}
 	hasher := sha256.New()
 	defer object.Close()
-	if _, err := io.Copy(hasher, object); err != nil {
-		logger.Fatal("Failed to read source object to checksum",
+	var head []byte
+	sniffed := ""
+	if contentPolicy.Enabled() {
+		head = make([]byte, policy.SniffLen)
+		n, err := io.ReadFull(object, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			logger.Error("Failed to read source object to sniff content",
+				zap.String("key", blob.Key),
+				zap.String("bucket", inbox),
+				zap.Error(err),
+			)
+			return transferFailed(blob, err)
+		}
+		head = head[:n]
+		sniffed = policy.Sniff(head)
+		if reason := contentPolicy.Check(objectInfo.ContentType, sniffed); reason != "" {
+			object.Close()
+			return reject(ctx, blob, contentPolicy.Action, reason, minioClient, logger)
+		}
+	}
+	var sink io.Writer = hasher
+	var stream *scan.Stream
+	if scanner != nil {
+		stream, err = scanner.Stream(ctx)
+		if err != nil {
+			logger.Error("Failed to start scan", zap.String("key", blob.Key), zap.Error(err))
+			return transferFailed(blob, err)
+		}
+		defer stream.Close()
+		// scanning while hashing means the upload is read once
+		sink = io.MultiWriter(hasher, stream)
+	}
+	if _, err := io.Copy(sink, io.MultiReader(bytes.NewReader(head), object)); err != nil {
+		logger.Error("Failed to read source object to checksum",
 			zap.String("key", blob.Key),
 			zap.String("bucket", inbox),
 			zap.Error(err),
 		)
+		return transferFailed(blob, err)
 	}
 	sha256hex := fmt.Sprintf("%x", hasher.Sum(nil))
 	logger.Debug("SHA256", zap.String("hex", sha256hex))
 
+	var scanned map[string]string
+	if stream != nil {
+		result, err := stream.Result()
+		if errors.Is(err, scan.ErrSizeLimit) {
+			object.Close()
+			return quarantineUpload(ctx, blob, objectInfo.ETag, "not scanned: "+err.Error(), nil, minioClient, logger)
+		}
+		if err != nil {
+			logger.Error("Failed to scan", zap.String("key", blob.Key), zap.Error(err))
+			return transferFailed(blob, err)
+		}
+		scanned = result.Metadata()
+		if result.Infected {
+			logger.Warn("Infected upload",
+				zap.String("key", blob.Key),
+				zap.String("signature", result.Signature),
+				zap.String("database", result.Database),
+			)
+			object.Close()
+			return quarantineUpload(ctx, blob, objectInfo.ETag, "infected "+result.Signature, scanned, minioClient, logger)
+		}
+	}
+
 	if dropEmptyFiles && sha256hex == emptyFileSha256 {
 		cleanupErr := minioClient.RemoveObject(ctx, inbox, blob.Key, minio.RemoveObjectOptions{})
 		if cleanupErr != nil {
-			logger.Fatal("Failed to remove empty file. Inbox item probably still exists.",
+			logger.Error("Failed to remove empty file. Inbox item probably still exists.",
 				zap.String("key", blob.Key),
 				zap.String("bucket", inbox),
-				zap.Error(err),
+				zap.Error(cleanupErr),
 			)
+			return transferFailed(blob, cleanupErr)
 		}
 		logger.Info("Dropped empty file", zap.String("key", blob.Key))
 		indexNext.AppendDrop(blob.Key)
-		return
+		return &bucket.TransferEvent{
+			Outcome: bucket.OutcomeDropped,
+			Upload:  blob.Key,
+			Reason:  "empty",
+			Time:    time.Now().UTC(),
+		}
 	}
 
 	write := fmt.Sprintf("%s/%s%s", archive, sha256hex, blob.Ext)
@@ -201,8 +605,9 @@ func transfer(ctx context.Context, blob uploaded, minioClient *minio.Client, log
 	)
 
 	src := minio.CopySrcOptions{
-		Bucket: inbox,
-		Object: blob.Key,
+		Bucket:    inbox,
+		Object:    blob.Key,
+		MatchETag: objectInfo.ETag,
 	}
 
 	blobDir := sha256hex[0:2] + "/" + sha256hex[2:4] + "/"
@@ -214,11 +619,12 @@ func transfer(ctx context.Context, blob uploaded, minioClient *minio.Client, log
 			logger.Debug("Destination path is new", zap.String("key", blobName))
 			err = nil
 		} else {
-			logger.Fatal("Failed to stat destination path",
+			logger.Error("Failed to stat destination path",
 				zap.String("key", blobName),
 				zap.String("bucket", archive),
 				zap.Error(err),
 			)
+			return transferFailed(blob, err)
 		}
 	} else {
 		logger.Info("Destination path already exists",
@@ -229,6 +635,12 @@ func transfer(ctx context.Context, blob uploaded, minioClient *minio.Client, log
 	}
 
 	meta := metadata.NewMetadataNext(objectInfo, existing)
+	if sniffed != "" {
+		meta.UserMetadata["Content-Sniffed"] = sniffed
+	}
+	for k, v := range scanned {
+		meta.UserMetadata[k] = v
+	}
 
 	// temp, based on an old todo, can probably be removed
 	if meta.UserMetadata["content-disposition"] == "" {
@@ -249,7 +661,7 @@ func transfer(ctx context.Context, blob uploaded, minioClient *minio.Client, log
 			zap.String("archive", archive),
 			zap.Error(err),
 		)
-		return
+		return transferFailed(blob, err)
 	}
 
 	// TODO with v7 we get uploadInfo so the safeguard below might not be needed
@@ -267,7 +679,7 @@ func transfer(ctx context.Context, blob uploaded, minioClient *minio.Client, log
 
 	// This check for destination existence is just a safeguard, because we don't get a lot of feedback from CopyObject
 	// Should we check that metadata was transferred too?
-	existing, confirmErr := minioClient.StatObject(ctx, archive, blobName, minio.StatObjectOptions{})
+	_, confirmErr := minioClient.StatObject(ctx, archive, blobName, minio.StatObjectOptions{})
 	if confirmErr != nil {
 		logger.Fatal("Destination blob not found after copy.",
 			zap.String("key", blobName),
@@ -281,14 +693,42 @@ func transfer(ctx context.Context, blob uploaded, minioClient *minio.Client, log
 		)
 		cleanupErr := minioClient.RemoveObject(ctx, inbox, blob.Key, minio.RemoveObjectOptions{})
 		if cleanupErr != nil {
-			logger.Fatal("Failed to clean up after blob copy. Inbox item probably still exists.",
-				zap.String("key", inbox),
-				zap.String("bucket", blob.Key),
-				zap.Error(err),
+			// a retry will find the blob as duplicate, and try cleanup again
+			logger.Error("Failed to clean up after blob copy. Inbox item probably still exists.",
+				zap.String("key", blob.Key),
+				zap.String("bucket", inbox),
+				zap.Error(cleanupErr),
 			)
+			return transferFailed(blob, cleanupErr)
 		}
 	}
 	transfersCompleted.Inc()
+
+	outcome := bucket.OutcomeArchived
+	if existing.Key != "" {
+		outcome = bucket.OutcomeDuplicate
+	}
+	return &bucket.TransferEvent{
+		Outcome: outcome,
+		Upload:  blob.Key,
+		Key:     uploadInfo.Key,
+		Etag:    uploadInfo.ETag,
+		Meta:    meta.UserMetadata,
+		Time:    time.Now().UTC(),
+	}
+}
+
+// publish fails fatally so that the notification isn't acked if a sink didn't get the event
+func publish(ctx context.Context, event *bucket.TransferEvent, logger *zap.Logger) {
+	for _, sink := range transferSinks {
+		if err := sink.Publish(ctx, event); err != nil {
+			logger.Fatal("Failed to publish transfer event",
+				zap.String("upload", event.Upload),
+				zap.String("outcome", string(event.Outcome)),
+				zap.Error(err),
+			)
+		}
+	}
 }
 
 func toExtension(key string) string {
@@ -299,13 +739,17 @@ func toExtension(key string) string {
 	return ext
 }
 
-// Will exit on unrecognized errors, but return err on errors we think we can recover from without crashloop
-func mainMinio(ctx context.Context, logger *zap.Logger) error {
-
+func newMinioClient(logger *zap.Logger) *minio.Client {
 	options := &minio.Options{
 		Creds:  credentials.NewStaticV4(accesskey, secretkey, ""),
 		Secure: false,
 	}
+	transport, err := minio.DefaultTransport(options.Secure)
+	if err != nil {
+		logger.Fatal("Failed to set up minio transport", zap.Error(err))
+	}
+	// sees the pings on ListenBucketNotification connections, for health and to replace stuck ones
+	options.Transport = listenActivity.Transport(transport)
 
 	logger.Info("Initializing minio client", zap.String("host", host), zap.Bool("https", secure))
 	minioClient, err := minio.New(host, options)
@@ -318,30 +762,240 @@ func mainMinio(ctx context.Context, logger *zap.Logger) error {
 	if trace {
 		minioClient.TraceOn(os.Stderr)
 	}
+	return minioClient
+}
+
+func writeIndex(ctx context.Context, minioClient *minio.Client, logger *zap.Logger) {
+	indexWriteMu.Lock()
+	defer indexWriteMu.Unlock()
+	writeIndexLocked(ctx, minioClient, logger)
+}
+
+// writeIndexLocked must be called with indexWriteMu held, which keeps index keys unique
+func writeIndexLocked(ctx context.Context, minioClient *minio.Client, logger *zap.Logger) {
+	if !indexWrite || indexNext.Size() == 0 {
+		return
+	}
+	indexKey := fmt.Sprintf("%s/%s",
+		indexWriteDir,
+		time.Now().UTC().Format("2006-01-02t150405.000.jsonlines"),
+	)
+	indexBody, indexBytes, entries, err := indexNext.Serialize(indexType)
+	if err != nil {
+		logger.Fatal("Failed to get index serializer", zap.Error(err))
+	}
+	if _, err := minioClient.PutObject(ctx, archive, indexKey, indexBody, indexBytes, minio.PutObjectOptions{}); err != nil {
+		// the entries are kept for the next write
+		logger.Error("Failed to write index", zap.String("key", indexKey), zap.Error(err))
+		return
+	}
+	indexNext.Truncate(entries)
+	logger.Info("Wrote index", zap.String("key", indexKey), zap.Int64("size", indexBytes), zap.Int("entries", entries))
+	// index keys have millisecond resolution
+	time.Sleep(time.Millisecond)
+}
+
+// flushIndex bounds the in-memory index in watch mode, writing it with --index and otherwise forgetting the older half
+func flushIndex(ctx context.Context, minioClient *minio.Client, logger *zap.Logger) {
+	if batch || indexNext.Size() < indexFlushEntries || !indexWriteMu.TryLock() {
+		return
+	}
+	defer indexWriteMu.Unlock()
+	if !indexWrite {
+		indexNext.Truncate(indexFlushEntries / 2)
+		return
+	}
+	writeIndexLocked(ctx, minioClient, logger)
+}
+
+// transferWithRetries is a transfer with tracking for the admin API, retries, and publish of the outcome
+func transferWithRetries(ctx context.Context, key string, trigger string, minioClient *minio.Client, logger *zap.Logger) *bucket.TransferEvent {
+	done := control.Begin(key, trigger)
+	defer done()
+	defer flushIndex(ctx, minioClient, logger)
+	transfersStarted.With(prometheus.Labels{"trigger": trigger}).Inc()
+	blob := uploaded{
+		Key: key,
+		Ext: toExtension(key),
+	}
+	event := transfer(ctx, blob, minioClient, logger)
+	policy := backoff.NewExponentialBackOff()
+	policy.InitialInterval = time.Second / 4
+	for attempt := 1; event.Outcome == bucket.OutcomeFailed && attempt < transferAttempts; attempt++ {
+		wait := policy.NextBackOff()
+		logger.Warn("Retrying failed transfer", zap.String("key", key), zap.Int("attempt", attempt+1), zap.Duration("wait", wait))
+		time.Sleep(wait)
+		transfersRetried.Inc()
+		event = transfer(ctx, blob, minioClient, logger)
+	}
+	if event.Outcome == bucket.OutcomeGone || event.Outcome == bucket.OutcomeIgnored {
+		// a no-op, the transfer that removed the upload has been published, or it's left in the inbox
+		return event
+	}
+	publish(ctx, event, logger)
+	return event
+}
+
+// replayReport is printed to stdout when a replay completes
+type replayReport struct {
+	DryRun        bool                    `json:"dryRun"`
+	Ranges        []kafka.ReplayPartition `json:"ranges"`
+	Notifications int                     `json:"notifications"`
+	Records       int                     `json:"records"`
+	// Gone are records whose upload is no longer in the inbox, i.e. already transferred or dropped
+	Gone int `json:"gone"`
+	// Ignored are records for another bucket or an event type that isn't configured
+	Ignored  int            `json:"ignored"`
+	Outcomes map[string]int `json:"outcomes"`
+	// Keys are, for a dry run, those that would be transferred
+	Keys []string `json:"keys,omitempty"`
+}
+
+// mainReplay reprocesses kafka notifications from a timestamp or offsets, returning the exit code
+func mainReplay(ctx context.Context, stop context.Context, minioClient *minio.Client, logger *zap.Logger) int {
+	if kafkaBootstrap == "" {
+		logger.Fatal("replay requires KAFKA_BOOTSTRAP")
+	}
+	config := &kafka.ReplayConfig{
+		Logger:    logger,
+		Bootstrap: strings.Split(kafkaBootstrap, ","),
+		Topics:    []string{kafkaTopic},
+		Auth:      getKafkaAuth(logger),
+		Filter: kafka.MessageFilter{
+			KeyPrefix: fmt.Sprintf("%s/", inbox),
+		},
+	}
+	var err error
+	if replayOffsets != "" {
+		if config.Offsets, err = kafka.ParseOffsets(replayOffsets); err != nil {
+			logger.Fatal("Failed to parse replay offsets", zap.String("value", replayOffsets), zap.Error(err))
+		}
+	} else if replayFrom != "" {
+		if config.From, err = time.Parse(time.RFC3339, replayFrom); err != nil {
+			logger.Fatal("Failed to parse replay timestamp", zap.String("value", replayFrom), zap.Error(err))
+		}
+	} else {
+		logger.Fatal("replay requires --from or --offsets")
+	}
+	assertBucketExists(ctx, inbox, minioClient, logger)
+	assertBucketExists(ctx, archive, minioClient, logger)
+
+	watcher, ranges := kafka.NewReplay(stop, config)
+	report := &replayReport{
+		DryRun:   replayDryRun,
+		Ranges:   ranges,
+		Outcomes: make(map[string]int),
+	}
+	for notificationInfo := range watcher.Uploads {
+		report.Notifications++
+		result := bucket.TransferOk
+		for _, record := range notificationInfo.Records {
+			report.Records++
+			if record.S3.Bucket.Name != inbox {
+				report.Ignored++
+				continue
+			}
+			// https://github.com/minio/minio/issues/7665#issuecomment-493681445
+			key, err := url.QueryUnescape(record.S3.Object.Key)
+			if err != nil {
+				logger.Fatal("Url decoding failed", zap.String("key", record.S3.Object.Key), zap.Error(err))
+			}
+			if record.EventName != "" && !eventTypes[record.EventName] {
+				logger.Info("Replay skipped, event type isn't configured", zap.String("key", key), zap.String("event", record.EventName))
+				report.Ignored++
+				continue
+			}
+			// a completed transfer removed the upload, and a remaining one is a duplicate at worst
+			if _, err := minioClient.StatObject(ctx, inbox, key, minio.StatObjectOptions{}); err != nil {
+				if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+					logger.Info("Replay skipped, upload already gone from inbox", zap.String("key", key))
+					report.Gone++
+					continue
+				}
+				logger.Error("Replay failed to stat upload", zap.String("key", key), zap.Error(err))
+				report.Outcomes[string(bucket.OutcomeFailed)]++
+				result = bucket.TransferFailed
+				continue
+			}
+			if replayDryRun {
+				report.Keys = append(report.Keys, key)
+				continue
+			}
+			event := transferWithRetries(ctx, key, "replay", minioClient, logger)
+			report.Outcomes[string(event.Outcome)]++
+			if event.Outcome == bucket.OutcomeFailed {
+				result = bucket.TransferFailed
+			}
+		}
+		watcher.Ack(ctx, result, &notificationInfo)
+	}
+	writeIndex(ctx, minioClient, logger)
+
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		logger.Fatal("Failed to serialize replay report", zap.Error(err))
+	}
+	fmt.Println(string(out))
+	if stop.Err() != nil {
+		logger.Warn("Replay interrupted, the report is partial")
+		return 1
+	}
+	if report.Outcomes[string(bucket.OutcomeFailed)] > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Will exit on unrecognized errors, but return err on errors we think we can recover from without crashloop.
+// Stops taking new work when stop is done, but transfers and acks use ctx so that they can complete.
+func mainMinio(ctx context.Context, stop context.Context, minioClient *minio.Client, logger *zap.Logger) error {
+	var err error
+
+	// watchers are stopped on return, including returns that lead to a re-run
+	watchCtx, cancelWatch := context.WithCancel(stop)
+	var watcher *bucket.InboxWatcher
+	defer func() {
+		cancelWatch()
+		if watcher != nil && watcher.Close != nil {
+			watcher.Close(ctx)
+		}
+	}()
 
 	// These variables predate the InboxWatcher interface, and should probably be incorporated there:
 	// - When to wait for bucket existence
 	waitForBucketExistence := func() {
 		assertBucketExists(ctx, inbox, minioClient, logger)
 		assertBucketExists(ctx, archive, minioClient, logger)
+		if quarantine != "" {
+			assertBucketExists(ctx, quarantine, minioClient, logger)
+		}
 		logger.Info("Bucket existence confirmed", zap.String("inbox", inbox), zap.String("archive", archive))
+		healthCheck.SetBucketsConfirmed(true)
 	}
 	// - Whether to url decode keys
 	urldecodeKeys := false
+	// - How to transfer, with retries and tracking for the admin API
+	transferItem := func(key string, trigger string) *bucket.TransferEvent {
+		return transferWithRetries(ctx, key, trigger, minioClient, logger)
+	}
 	// - What to do with existing items
 	handleExistingItem := func(object minio.ObjectInfo) {
 		logger.Info("Existing inbox object to be transferred", zap.String("key", object.Key))
-		transfersStarted.With(prometheus.Labels{"trigger": "listing"}).Inc()
-		transfer(ctx, uploaded{
-			Key: object.Key,
-			Ext: toExtension(object.Key),
-		}, minioClient, logger)
+		transferItem(object.Key, "listing")
 	}
 
-	var watcher *bucket.InboxWatcher
+	sources := 0
+	for _, configured := range []string{kafkaBootstrap, natsUrl, amqpUrl, redisUrl, webhookReceiverToken, pollInterval} {
+		if configured != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		logger.Fatal("kafka, nats, amqp, redis, webhook receiver and polling modes cannot be combined")
+	}
 	if batch {
-		if kafkaBootstrap != "" {
-			zap.L().Fatal("batch and kafka mode cannot be combined")
+		if sources > 0 {
+			zap.L().Fatal("batch and kafka, nats, amqp, redis, webhook receiver or polling mode cannot be combined")
 		}
 		logger.Info("Batch mode enabled, no listener will be created")
 	} else if kafkaBootstrap != "" {
@@ -354,7 +1008,9 @@ func mainMinio(ctx context.Context, logger *zap.Logger) error {
 			Filter: kafka.MessageFilter{
 				KeyPrefix: fmt.Sprintf("%s/", inbox),
 			},
-			FetchMaxWait: kafkaFetchMaxWaiDefault,
+			FetchMaxWait:    kafkaFetchMaxWaiDefault,
+			DeadLetterTopic: kafkaDeadLetterTopic,
+			Auth:            getKafkaAuth(logger),
 		}
 		if kafkaFetchMaxWait != "" {
 			config.FetchMaxWait, err = time.ParseDuration(kafkaFetchMaxWait)
@@ -362,7 +1018,19 @@ func mainMinio(ctx context.Context, logger *zap.Logger) error {
 				logger.Fatal("Failed to parse FetchMaxWait config", zap.String("value", kafkaFetchMaxWait))
 			}
 		}
-		watcher = kafka.NewKafka(ctx, config)
+		if kafkaCommitInterval != "" {
+			config.CommitInterval, err = time.ParseDuration(kafkaCommitInterval)
+			if err != nil {
+				logger.Fatal("Failed to parse CommitInterval config", zap.String("value", kafkaCommitInterval))
+			}
+		}
+		if kafkaCommitBatch != "" {
+			config.CommitBatch, err = strconv.Atoi(kafkaCommitBatch)
+			if err != nil {
+				logger.Fatal("Failed to parse CommitBatch config", zap.String("value", kafkaCommitBatch))
+			}
+		}
+		watcher = kafka.NewKafka(watchCtx, config)
 		waitForBucketExistence()
 		urldecodeKeys = true // https://github.com/minio/minio/issues/7665#issuecomment-493681445
 		handleExistingItem = func(object minio.ObjectInfo) {
@@ -370,99 +1038,433 @@ func mainMinio(ctx context.Context, logger *zap.Logger) error {
 				zap.String("key", object.Key),
 			)
 		}
-	} else {
+	} else if amqpUrl != "" {
+		logger.Info("Starting AMQP bucket notifications listener")
+		if amqpQueue == "" {
+			logger.Fatal("AMQP_URL requires AMQP_QUEUE")
+		}
+		config := &amqp.AmqpConsumerConfig{
+			Logger:             logger,
+			Url:                amqpUrl,
+			Queue:              amqpQueue,
+			Exchange:           amqpExchange,
+			RoutingKey:         amqpRoutingKey,
+			ExchangeType:       amqpExchangeType,
+			DeadLetterExchange: amqpDeadLetterExchange,
+			Filter: kafka.MessageFilter{
+				KeyPrefix: fmt.Sprintf("%s/", inbox),
+			},
+		}
+		if amqpPrefetch != "" {
+			config.Prefetch, err = strconv.Atoi(amqpPrefetch)
+			if err != nil {
+				logger.Fatal("Failed to parse Prefetch config", zap.String("value", amqpPrefetch))
+			}
+		}
+		watcher = amqp.NewAmqp(watchCtx, config)
 		waitForBucketExistence()
-		logger.Info("Starting standalone bucket notifications listener")
-		watcher = &bucket.InboxWatcher{
-			Uploads: minioClient.ListenBucketNotification(ctx, inbox, "", "", []string{
-				"s3:ObjectCreated:Put",
-			}),
-			Ack: func(ackctx context.Context, tr bucket.TransferResult, i *notification.Info) {
-				if tr == bucket.TransferFailed {
-					logger.Error("Nack on transfer failure not implemented")
-				} else {
-					logger.Debug("Ack is a no-op for ListenBucketNotification")
-				}
+		urldecodeKeys = true // same event format as kafka
+		handleExistingItem = func(object minio.ObjectInfo) {
+			logger.Warn("Existing ignored; the queue should hold notifications for prior uploads",
+				zap.String("key", object.Key),
+			)
+		}
+	} else if natsUrl != "" {
+		logger.Info("Starting NATS JetStream bucket notifications listener")
+		if natsStream == "" {
+			logger.Fatal("NATS_URL requires NATS_STREAM")
+		}
+		config := &nats.NatsConsumerConfig{
+			Logger:  logger,
+			Url:     natsUrl,
+			Stream:  natsStream,
+			Subject: natsSubject,
+			Durable: natsDurable,
+			Filter: kafka.MessageFilter{
+				KeyPrefix: fmt.Sprintf("%s/", inbox),
 			},
 		}
+		if natsNakDelay != "" {
+			config.NakDelay, err = time.ParseDuration(natsNakDelay)
+			if err != nil {
+				logger.Fatal("Failed to parse NakDelay config", zap.String("value", natsNakDelay))
+			}
+		}
+		watcher = nats.NewNats(watchCtx, config)
+		waitForBucketExistence()
+		urldecodeKeys = true // same event format as kafka
+		handleExistingItem = func(object minio.ObjectInfo) {
+			logger.Warn("Existing ignored; the durable consumer should track prior uploads",
+				zap.String("key", object.Key),
+			)
+		}
+	} else if redisUrl != "" {
+		logger.Info("Starting Redis stream bucket notifications listener")
+		if redisStream == "" {
+			logger.Fatal("REDIS_URL requires REDIS_STREAM")
+		}
+		if redisConsumer == "" {
+			logger.Fatal("Redis consumer name required but not set, and no HOST env")
+		}
+		if redisList == "" {
+			logger.Info("Without REDIS_LIST the stream must be fed with MinIO's event logs by something else, as MinIO's Redis target can't write streams")
+		}
+		config := &redis.RedisConsumerConfig{
+			Logger:   logger,
+			Url:      redisUrl,
+			Stream:   redisStream,
+			Group:    redisGroup,
+			Consumer: redisConsumer,
+			Field:    redisField,
+			List:     redisList,
+			Filter: kafka.MessageFilter{
+				KeyPrefix: fmt.Sprintf("%s/", inbox),
+			},
+		}
+		if redisClaimIdle != "" {
+			config.ClaimIdle, err = time.ParseDuration(redisClaimIdle)
+			if err != nil {
+				logger.Fatal("Failed to parse ClaimIdle config", zap.String("value", redisClaimIdle))
+			}
+		}
+		watcher = redis.NewRedis(watchCtx, config)
+		waitForBucketExistence()
+		urldecodeKeys = true // same event format as kafka
+		handleExistingItem = func(object minio.ObjectInfo) {
+			logger.Warn("Existing ignored; the consumer group should track prior uploads",
+				zap.String("key", object.Key),
+			)
+		}
+	} else if webhookReceiverToken != "" {
+		logger.Info("Starting webhook bucket notifications receiver", zap.String("path", webhook.ReceiverPath))
+		watcher = webhookReceiver.Watcher(watchCtx)
+		waitForBucketExistence()
+		urldecodeKeys = true // same event format as kafka
+		handleExistingItem = func(object minio.ObjectInfo) {
+			logger.Warn("Existing ignored; MinIO's queue_dir should retry notifications for prior uploads",
+				zap.String("key", object.Key),
+			)
+		}
+	} else if pollInterval != "" {
+		logger.Info("Starting inbox polling watcher")
+		config := &polling.PollingConfig{
+			Logger: logger,
+			Client: minioClient,
+			Bucket: inbox,
+		}
+		leaveKeys := keyPolicy.Enabled() && keyPolicy.Action == policy.ActionLeave
+		leaveSizes := sizePolicy.Enabled() && sizePolicy.Action == policy.ActionLeave
+		if leaveKeys || leaveSizes {
+			// or they'd be emitted at every listing, and Reason doesn't count them or they'd be counted at every listing too
+			config.Skip = func(object minio.ObjectInfo) bool {
+				return (leaveKeys && keyPolicy.Reason(object.Key) != "") ||
+					(leaveSizes && sizePolicy.Reason(object.Size) != "")
+			}
+		}
+		if contentPolicy.Enabled() && contentPolicy.Action == policy.ActionLeave {
+			logger.Warn("Uploads that the content policy leaves in the inbox are read again at every poll")
+		}
+		config.Interval, err = time.ParseDuration(pollInterval)
+		if err != nil {
+			logger.Fatal("Failed to parse Interval config", zap.String("value", pollInterval))
+		}
+		if pollMinAge != "" {
+			config.MinAge, err = time.ParseDuration(pollMinAge)
+			if err != nil {
+				logger.Fatal("Failed to parse MinAge config", zap.String("value", pollMinAge))
+			}
+		}
+		waitForBucketExistence()
+		watcher = polling.NewPolling(watchCtx, config)
+		handleExistingItem = func(object minio.ObjectInfo) {
+			logger.Debug("Existing left to the polling watcher", zap.String("key", object.Key))
+		}
+	} else {
+		waitForBucketExistence()
+		logger.Info("Starting standalone bucket notifications listener")
+		watcher = listener.NewListener(watchCtx, &listener.ListenerConfig{
+			Logger:   logger,
+			Client:   minioClient,
+			Bucket:   inbox,
+			Events:   eventNames(),
+			Activity: listenActivity,
+		})
 	}
 
-	logger.Info("Listing existing inbox objects")
-	objectCh := minioClient.ListObjects(ctx, inbox, minio.ListObjectsOptions{
-		Recursive: true,
-	})
-	for object := range objectCh {
-		if object.Err != nil {
-			logger.Error("List object error", zap.Error(object.Err))
-			return object.Err
+	// relistItem transfers objects listed at the admin's request, also in modes where the startup listing leaves them to notifications
+	relistItem := func(object minio.ObjectInfo) {
+		logger.Info("Relisted inbox object to be transferred", zap.String("key", object.Key))
+		transferItem(object.Key, "relist")
+	}
+
+	listInbox := func(handle func(object minio.ObjectInfo)) error {
+		logger.Info("Listing existing inbox objects")
+		objectCh := minioClient.ListObjects(watchCtx, inbox, minio.ListObjectsOptions{
+			Recursive: true,
+		})
+		for object := range objectCh {
+			if stop.Err() != nil {
+				return errShutdown
+			}
+			if object.Err != nil {
+				logger.Error("List object error", zap.Error(object.Err))
+				return object.Err
+			}
+			handle(object)
 		}
-		handleExistingItem(object)
+		return nil
+	}
+	if err := listInbox(handleExistingItem); err != nil {
+		return err
 	}
 
 	if batch {
-		if indexWrite && indexNext.Size() > 0 {
-			indexKey := fmt.Sprintf("%s/%s",
-				indexWriteDir,
-				time.Now().UTC().Format("2006-01-02t150405.jsonlines"),
-			)
-			indexBody, indexBytes, err := indexNext.Serialize(indexType)
+		writeIndex(ctx, minioClient, logger)
+		return nil
+	}
+
+	// handleRecord transfers a record's upload, unless it's a no-op, and returns failed only for failed transfers
+	handleRecord := func(record notification.Event) bucket.TransferResult {
+		key := record.S3.Object.Key
+		if urldecodeKeys {
+			var err error
+			key, err = url.QueryUnescape(key)
 			if err != nil {
-				logger.Fatal("Failed to get index serializer", zap.Error(err))
+				logger.Fatal("Url decoding failed", zap.String("key", key), zap.Error(err))
 			}
-			minioClient.PutObject(ctx, archive, indexKey, indexBody, indexBytes, minio.PutObjectOptions{})
-			logger.Info("Wrote index", zap.String("key", indexKey), zap.Int64("size", indexBytes))
 		}
-		return nil
+		bucketName := record.S3.Bucket.Name
+		logger.Info("Notification record",
+			zap.String("bucket", bucketName),
+			zap.String("key", key),
+		)
+		if bucketName != inbox {
+			logger.Error("Unexpected notification bucket. Ignoring.",
+				zap.String("name", bucketName),
+				zap.String("expected", inbox))
+			ignoredUnexpectedBucket.Inc()
+			return bucket.TransferOk
+		}
+		if record.EventName != "" && !eventTypes[record.EventName] {
+			logger.Info("Notification for an event type that isn't configured", zap.String("key", key), zap.String("event", record.EventName))
+			notificationsNoop.With(prometheus.Labels{"reason": "event"}).Inc()
+			return bucket.TransferOk
+		}
+		id := sequencer.Id(record)
+		if sequencers.Seen(id) {
+			logger.Info("Redelivered notification, already transferred", zap.String("key", key), zap.String("id", id))
+			notificationsNoop.With(prometheus.Labels{"reason": "redelivered"}).Inc()
+			return bucket.TransferOk
+		}
+		// transfer and publish are sync so we can ack when all records are done
+		event := transferItem(key, notificationTrigger(record))
+		if event.Outcome == bucket.OutcomeFailed {
+			return bucket.TransferFailed
+		}
+		if event.Outcome == bucket.OutcomeIgnored {
+			// counted by the policy, and checked again if it's notified again
+			return bucket.TransferOk
+		}
+		if err := sequencers.Add(id); err != nil {
+			logger.Error("Failed to persist sequencer", zap.String("id", id), zap.Error(err))
+		}
+		if event.Outcome == bucket.OutcomeGone {
+			notificationsNoop.With(prometheus.Labels{"reason": "gone"}).Inc()
+			return bucket.TransferOk
+		}
+		if eventTime, err := time.Parse(time.RFC3339Nano, record.EventTime); err == nil {
+			archiveLatency.With(prometheus.Labels{"outcome": string(event.Outcome)}).Observe(event.Time.Sub(eventTime).Seconds())
+		} else {
+			logger.Debug("No latency for unparseable event time", zap.String("eventTime", record.EventTime))
+		}
+		return bucket.TransferOk
+	}
+	handleNotification := func(notificationInfo notification.Info) {
+		if watcher.Begin != nil && !watcher.Begin(&notificationInfo) {
+			return
+		}
+		// each record is transferred, and the notification acked once, failed if any record failed
+		result := bucket.TransferOk
+		for _, record := range notificationInfo.Records {
+			if handleRecord(record) == bucket.TransferFailed {
+				result = bucket.TransferFailed
+			}
+		}
+		watcher.Ack(ctx, result, &notificationInfo)
 	}
 
-	for notificationInfo := range watcher.Uploads {
-		if notificationInfo.Err != nil {
-			// Can't test these failure modes with the current build infra, but we fall back to crashlooping if detection fails.
-			// If we get errors without any successful notifications we'll transfer files anyway, per the ListObjects above.
-			if notificationInfo.Err.Error() == "unexpected end of JSON input" {
-				logger.Info("Notification abort, which we think is a timeout", zap.Error(notificationInfo.Err))
-				return notificationInfo.Err
+	// Lanes run records concurrently, with the same key always in the same lane to keep per-key order.
+	// A notification with several records is split over their lanes, and acked once when its last record is done.
+	// Kafka partitions from MinIO are keyed on bucket and key too, so a lane never reorders a partition's records for a key.
+	dispatch := handleNotification
+	// inLane runs other work on a key, relists and retries, in order with the key's notifications
+	inLane := func(key string, work func()) {
+		work()
+	}
+	if workers > 1 {
+		lanes := make([]chan func(), workers)
+		var lanesDone sync.WaitGroup
+		for i := range lanes {
+			lanes[i] = make(chan func(), laneBuffer)
+			lanesDone.Add(1)
+			go func(lane <-chan func()) {
+				defer lanesDone.Done()
+				for work := range lane {
+					work()
+				}
+			}(lanes[i])
+		}
+		// registered after watcher.Close so that lanes finish their acks first
+		defer func() {
+			for _, lane := range lanes {
+				close(lane)
 			}
-			if strings.HasPrefix(notificationInfo.Err.Error(), "readObjectStart: expect { or n, but found ") {
-				logger.Info("Notification abort, which we think is a timeout", zap.Error(notificationInfo.Err))
-				return notificationInfo.Err
+			lanesDone.Wait()
+		}()
+		// laneOf hashes the key as transferred, which notifications may have url encoded
+		laneOf := func(key string) chan<- func() {
+			if urldecodeKeys {
+				if decoded, err := url.QueryUnescape(key); err == nil {
+					key = decoded
+				}
 			}
-			logger.Fatal("Notification error",
-				zap.Error(notificationInfo.Err),
-			)
+			hash := fnv.New32a()
+			hash.Write([]byte(key))
+			return lanes[int(hash.Sum32()%uint32(len(lanes)))]
 		}
-		for _, record := range notificationInfo.Records {
-			key := record.S3.Object.Key
-			if urldecodeKeys {
-				key, err = url.QueryUnescape(key)
-				if err != nil {
-					logger.Fatal("Url decoding failed", zap.String("key", key), zap.Error(err))
+		inLane = func(key string, work func()) {
+			select {
+			case laneOf(key) <- work:
+			case <-stop.Done():
+			}
+		}
+		dispatch = func(notificationInfo notification.Info) {
+			if len(notificationInfo.Records) == 0 {
+				handleNotification(notificationInfo)
+				return
+			}
+			// Begin is called by the first record to start, and the last record to finish acks,
+			// or abandons the notification if a stop left some of its records undispatched
+			var begin sync.Once
+			begun := false
+			abandoned := false
+			var mu sync.Mutex
+			remaining := len(notificationInfo.Records)
+			result := bucket.TransferOk
+			finish := func() {
+				if !begun {
+					return
 				}
+				if abandoned {
+					if watcher.Abandon != nil {
+						watcher.Abandon(&notificationInfo)
+					}
+					return
+				}
+				watcher.Ack(ctx, result, &notificationInfo)
 			}
-			bucketName := record.S3.Bucket.Name
-			logger.Info("Notification record",
-				zap.String("bucket", bucketName),
-				zap.String("key", key),
-			)
-			if bucketName != inbox {
-				logger.Error("Unexpected notification bucket. Ignoring.",
-					zap.String("name", bucketName),
-					zap.String("expected", inbox))
-				ignoredUnexpectedBucket.Inc()
-				continue
+			for i, record := range notificationInfo.Records {
+				work := func() {
+					begin.Do(func() {
+						begun = watcher.Begin == nil || watcher.Begin(&notificationInfo)
+					})
+					recordResult := bucket.TransferOk
+					if begun {
+						recordResult = handleRecord(record)
+					}
+					mu.Lock()
+					remaining--
+					if recordResult == bucket.TransferFailed {
+						result = bucket.TransferFailed
+					}
+					last := remaining == 0
+					mu.Unlock()
+					if last {
+						finish()
+					}
+				}
+				// a full lane blocks dispatch, which is our backpressure, but a stop must not wait for it.
+				// A notification that's only partly dispatched is never acked, so it's redelivered.
+				select {
+				case laneOf(record.S3.Object.Key) <- work:
+				case <-stop.Done():
+					mu.Lock()
+					abandoned = true
+					remaining -= len(notificationInfo.Records) - i
+					last := remaining == 0
+					mu.Unlock()
+					if last {
+						finish()
+					}
+					return
+				}
 			}
-			transfersStarted.With(prometheus.Labels{"trigger": "notification"}).Inc()
-			transfer(ctx, uploaded{
-				Key: key,
-				Ext: toExtension(key),
-			}, minioClient, logger)
-			// transfer is sync and errors are fatal so we can ack here
-			watcher.Ack(ctx, bucket.TransferOk, &notificationInfo)
 		}
+		logger.Info("Notifications are processed in parallel lanes", zap.Int("workers", workers))
 	}
 
-	logger.Error("Listener exited without an error, or we failed to handle an error")
-	return nil
+	control.SetPending(watcher.Pending)
+	if kafkaBootstrap != "" {
+		healthCheck.SetWatcher("kafka", watcher.LastSeen)
+	} else if natsUrl != "" {
+		healthCheck.SetWatcher("nats", watcher.LastSeen)
+	} else if amqpUrl != "" {
+		healthCheck.SetWatcher("amqp", watcher.LastSeen)
+	} else if redisUrl != "" {
+		healthCheck.SetWatcher("redis", watcher.LastSeen)
+	} else if webhookReceiverToken != "" {
+		healthCheck.SetWatcher("webhook", watcher.LastSeen)
+	} else if pollInterval != "" {
+		healthCheck.SetWatcher("polling", watcher.LastSeen)
+	} else {
+		healthCheck.SetWatcher("listen", watcher.LastSeen)
+	}
+	for {
+		// a stop takes precedence over any work that is ready
+		if stop.Err() != nil {
+			logger.Info("Stopped taking notifications")
+			return errShutdown
+		}
+		uploads := watcher.Uploads
+		if control.Paused() {
+			uploads = nil
+		}
+		select {
+		case <-stop.Done():
+			continue
+		case <-control.Changed():
+			logger.Info("Notification processing", zap.Bool("paused", control.Paused()))
+		case <-control.Relists():
+			// the watcher is fine, and the admin can request another relist
+			err := listInbox(func(object minio.ObjectInfo) {
+				inLane(object.Key, func() { relistItem(object) })
+			})
+			if err != nil && err != errShutdown {
+				logger.Error("Relist failed", zap.Error(err))
+			}
+		case key := <-control.Retries():
+			_, err := minioClient.StatObject(ctx, inbox, key, minio.StatObjectOptions{})
+			if err != nil {
+				logger.Warn("Retry requested for an inbox object that can't be read", zap.String("key", key), zap.Error(err))
+				continue
+			}
+			inLane(key, func() { transferItem(key, "retry") })
+		case notificationInfo, ok := <-uploads:
+			if !ok {
+				logger.Error("Listener exited without an error, or we failed to handle an error")
+				return nil
+			}
+			healthCheck.Progress()
+			if errors.Is(notificationInfo.Err, bucket.ErrConnectionLost) {
+				return notificationInfo.Err
+			}
+			if notificationInfo.Err != nil {
+				// watchers handle their own errors, including the listener's reconnects, so we fall back to crashlooping
+				logger.Fatal("Notification error", zap.Error(notificationInfo.Err))
+			}
+			dispatch(notificationInfo)
+		}
+	}
 }
 
 type OnHttp struct {
@@ -485,10 +1487,34 @@ func (o *OnHttp) AddCallbackAfterResponse(callback func()) {
 	o.callbacks = append(o.callbacks, callback)
 }
 
+// newWebhookReceiver is created once, as its routes and metrics can't be registered again at a re-run
+func newWebhookReceiver(logger *zap.Logger, registerer prometheus.Registerer) *webhook.Receiver {
+	config := &webhook.ReceiverConfig{
+		Logger: logger,
+		Token:  webhookReceiverToken,
+		Filter: kafka.MessageFilter{
+			KeyPrefix: fmt.Sprintf("%s/", inbox),
+		},
+		Registerer: registerer,
+	}
+	if webhookReceiverWait != "" {
+		var err error
+		config.Wait, err = time.ParseDuration(webhookReceiverWait)
+		if err != nil {
+			logger.Fatal("Failed to parse Wait config", zap.String("value", webhookReceiverWait))
+		}
+	}
+	return webhook.NewReceiver(config)
+}
+
 func main() {
+	parseFlags()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	stop, stopped := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stopped()
+
 	logger, _ := zap.NewDevelopment()
 	defer logger.Sync()
 
@@ -496,7 +1522,129 @@ func main() {
 	if batchmetrics && !batch {
 		logger.Fatal("batchmetrics without batch")
 	}
+	if !replay && (replayFrom != "" || replayOffsets != "" || replayDryRun) {
+		logger.Fatal("--from, --offsets and --dryrun are for the replay command")
+	}
 	http.Handle("/metrics", onMetrics.handler)
+	eventTypes = parseEvents(logger)
+	action, err := policy.ParseAction(excludeAction)
+	if err != nil {
+		logger.Fatal("Invalid exclude action", zap.Error(err))
+	}
+	keyPolicy, err = policy.NewKeyPolicy(includeKeys, excludeKeys, action, prometheus.DefaultRegisterer)
+	if err != nil {
+		logger.Fatal("Invalid include or exclude rule", zap.Error(err))
+	}
+	if keyPolicy.Enabled() && action == policy.ActionQuarantine && quarantine == "" {
+		logger.Fatal("Quarantine action requires --quarantine")
+	}
+	if keyPolicy.Enabled() {
+		logger.Info("Key policy enabled",
+			zap.Strings("include", includeKeys),
+			zap.Strings("exclude", excludeKeys),
+			zap.String("action", string(action)),
+		)
+	}
+	action, err = policy.ParseAction(sizeAction)
+	if err != nil {
+		logger.Fatal("Invalid size action", zap.Error(err))
+	}
+	sizePolicy, err = policy.NewSizePolicy(minSize, maxSize, action, prometheus.DefaultRegisterer)
+	if err != nil {
+		logger.Fatal("Invalid size limits", zap.Error(err))
+	}
+	if sizePolicy.Enabled() && action == policy.ActionQuarantine && quarantine == "" {
+		logger.Fatal("Quarantine action requires --quarantine")
+	}
+	if sizePolicy.Enabled() {
+		logger.Info("Size policy enabled",
+			zap.Int64("min", minSize),
+			zap.Int64("max", maxSize),
+			zap.String("action", string(action)),
+		)
+	}
+	action, err = policy.ParseAction(contentAction)
+	if err != nil {
+		logger.Fatal("Invalid content action", zap.Error(err))
+	}
+	contentPolicy, err = policy.NewContentPolicy(allowTypes, action, prometheus.DefaultRegisterer)
+	if err != nil {
+		logger.Fatal("Invalid allowed content type", zap.Error(err))
+	}
+	if contentPolicy.Enabled() && action == policy.ActionQuarantine && quarantine == "" {
+		logger.Fatal("Quarantine action requires --quarantine")
+	}
+	if contentPolicy.Enabled() {
+		logger.Info("Content policy enabled",
+			zap.Strings("allow", contentPolicy.Allow),
+			zap.String("action", string(action)),
+		)
+	}
+	if clamdAddress != "" {
+		if quarantine == "" {
+			logger.Fatal("Scanning with --clamd requires --quarantine")
+		}
+		scanner, err = scan.NewClamd(&scan.ClamdConfig{
+			Logger:  logger,
+			Address: clamdAddress,
+			Timeout: clamdTimeout,
+		})
+		if err != nil {
+			logger.Fatal("Invalid clamd address", zap.Error(err))
+		}
+		logger.Info("Scanning uploads", zap.String("clamd", clamdAddress))
+	}
+
+	minioClient := newMinioClient(logger)
+	indexNext = index.New()
+
+	if sequencerCacheFile != "" {
+		var err error
+		sequencers, err = sequencer.Open(sequencerCacheFile, sequencerCacheSize)
+		if err != nil {
+			logger.Fatal("Failed to open sequencer cache", zap.String("file", sequencerCacheFile), zap.Error(err))
+		}
+		defer sequencers.Close()
+		logger.Info("Sequencer cache loaded", zap.String("file", sequencerCacheFile), zap.Int("size", sequencers.Size()))
+	} else {
+		sequencers = sequencer.New(sequencerCacheSize)
+	}
+
+	if queryApi {
+		lookup := query.NewCachedLookup(query.NewMinioLookup(minioClient, archive), queryCacheTtl, queryCacheMax)
+		var written *minio.Client
+		if indexWrite {
+			written = minioClient
+		}
+		resolve := query.NewCachedResolver(query.NewIndexResolver(indexNext.LookupUpload, written, archive, indexWriteDir), queryCacheTtl, queryCacheMax)
+		query.New(logger, lookup, resolve).Register(http.DefaultServeMux)
+		logger.Info("Query API enabled", zap.Duration("cachettl", queryCacheTtl))
+	}
+
+	healthCheck = health.New(&health.HealthConfig{
+		Logger:         logger,
+		RequireWatcher: !batch,
+		StallAfter:     stallAfter,
+		SilentAfter:    silentAfter,
+		OldestInflight: func() (time.Time, bool) {
+			if inflight := control.Inflight(); len(inflight) > 0 {
+				return inflight[0].Started, true
+			}
+			return time.Time{}, false
+		},
+	})
+	healthCheck.Register(http.DefaultServeMux)
+
+	if adminToken != "" {
+		admin.New(logger, adminToken, control).Register(http.DefaultServeMux)
+		logger.Info("Admin API enabled")
+	}
+
+	if webhookReceiverToken != "" {
+		webhookReceiver = newWebhookReceiver(logger, prometheus.DefaultRegisterer)
+		webhookReceiver.Register(http.DefaultServeMux)
+	}
+
 	go func() {
 		logger.Info("Starting /metrics server", zap.String("bound", metrics))
 		err := http.ListenAndServe(metrics, nil)
@@ -505,14 +1653,77 @@ func main() {
 		}
 	}()
 
-	indexNext = index.New()
-	if indexWrite && !batch {
-		logger.Fatal("index only allowed in batch mode, TBD when to serialize in watch mode")
+	if kafkaResultsTopic != "" {
+		if kafkaBootstrap == "" {
+			logger.Fatal("KAFKA_RESULTS_TOPIC requires KAFKA_BOOTSTRAP")
+		}
+		producer := kafka.NewKafkaProducer(&kafka.KafkaProducerConfig{
+			Logger:    logger,
+			Bootstrap: strings.Split(kafkaBootstrap, ","),
+			Topic:     kafkaResultsTopic,
+			Auth:      getKafkaAuth(logger),
+		})
+		defer producer.Close()
+		transferSinks = append(transferSinks, producer)
+	}
+
+	if webhookUrl != "" {
+		if webhookQueueDir == "" {
+			logger.Fatal("WEBHOOK_URL requires WEBHOOK_QUEUE_DIR, for events that are undelivered when their notification is acked")
+		}
+		config := &webhook.SinkConfig{
+			Logger:     logger,
+			URL:        webhookUrl,
+			Secret:     []byte(webhookSecret),
+			QueueDir:   webhookQueueDir,
+			MaxElapsed: webhookMaxElapsedDefault,
+		}
+		if webhookMaxElapsed != "" {
+			var err error
+			config.MaxElapsed, err = time.ParseDuration(webhookMaxElapsed)
+			if err != nil {
+				logger.Fatal("Failed to parse webhook MaxElapsed config", zap.String("value", webhookMaxElapsed))
+			}
+		}
+		transferSinks = append(transferSinks, webhook.NewSink(ctx, config))
+	}
+
+	if replay {
+		if batch {
+			logger.Fatal("batch and replay cannot be combined")
+		}
+		if code := mainReplay(ctx, stop, minioClient, logger); code != 0 {
+			logger.Sync()
+			os.Exit(code)
+		}
+		return
 	}
 
+	go func() {
+		<-stop.Done()
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Info("Shutdown requested, draining", zap.Duration("timeout", shutdownTimeout))
+		healthCheck.SetWatcher("", nil)
+		time.AfterFunc(shutdownTimeout, func() {
+			logger.Error("Shutdown timeout exceeded, exiting with transfers in flight",
+				zap.Any("inflight", control.Inflight()),
+			)
+			logger.Sync()
+			os.Exit(1)
+		})
+	}()
+
 	for {
-		err := mainMinio(ctx, logger)
+		err := mainMinio(ctx, stop, minioClient, logger)
+		if errors.Is(err, errShutdown) {
+			writeIndex(ctx, minioClient, logger)
+			logger.Info("Shutdown completed")
+			return
+		}
 		if err != nil {
+			healthCheck.SetWatcher("", nil)
 			// Do we need backoff here? Maybe not while we're so specific about which error that triggers re-run.
 			if restartDelay != 0 {
 				logger.Info("Re-running handler", zap.Duration("delay", restartDelay), zap.Error(err))
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap/zaptest"
+	"repos.se/minio-deduplication/v2/pkg/health"
+	"repos.se/minio-deduplication/v2/pkg/index"
+	"repos.se/minio-deduplication/v2/pkg/sequencer"
+	"repos.se/minio-deduplication/v2/pkg/webhook"
+)
+
+// fakeS3 has every bucket, and every bucket is empty
+func fakeS3(t *testing.T) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case r.URL.Query().Has("location"):
+			w.Write([]byte(`<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></LocationConstraint>`))
+		case r.URL.Query().Get("list-type") == "2":
+			w.Write([]byte(`<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><IsTruncated>false</IsTruncated></ListBucketResult>`))
+		default:
+			t.Errorf("Unexpected S3 request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestMainMinioRerunWebhook(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	host = fakeS3(t)
+	inbox, archive = "bucket.write", "bucket.read"
+	webhookReceiverToken = "t"
+	eventTypes = parseEvents(logger)
+	sequencers = sequencer.New(10)
+	indexNext = index.New()
+	healthCheck = health.New(&health.HealthConfig{Logger: logger})
+	minioClient := newMinioClient(logger)
+
+	// like main, which registers the routes once for all runs
+	webhookReceiver = newWebhookReceiver(logger, prometheus.NewRegistry())
+	mux := http.NewServeMux()
+	webhookReceiver.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// an event type that isn't configured is acked without a transfer
+	event := `{"EventName":"s3:ObjectCreated:PutTagging","Key":"bucket.write/a.txt",` +
+		`"Records":[{"eventName":"s3:ObjectCreated:PutTagging","s3":{"bucket":{"name":"bucket.write"},"object":{"key":"a.txt","sequencer":"1"}}}]}`
+	// notifications get 503 until mainMinio has a watcher, which MinIO retries
+	notify := func() {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(50 * time.Millisecond) {
+			req, _ := http.NewRequest(http.MethodPost, server.URL+webhook.ReceiverPath, strings.NewReader(event))
+			req.Header.Set("Authorization", "Bearer t")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode == http.StatusNoContent {
+				return
+			}
+		}
+		t.Error("Expected the notification to be handled")
+	}
+
+	for run := 1; run <= 2; run++ {
+		stop, stopRun := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- mainMinio(context.Background(), stop, minioClient, logger)
+		}()
+		notify()
+		stopRun()
+		if err := <-done; err != errShutdown {
+			t.Errorf("Expected run %d to stop with errShutdown, got %v", run, err)
+		}
+	}
+}
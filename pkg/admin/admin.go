@@ -0,0 +1,92 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Admin serves operator endpoints, all of which require a bearer token
+type Admin struct {
+	logger  *zap.Logger
+	token   []byte
+	control *Control
+}
+
+func New(logger *zap.Logger, token string, control *Control) *Admin {
+	if token == "" {
+		logger.Fatal("Admin API requires a token")
+	}
+	return &Admin{
+		logger:  logger,
+		token:   []byte(token),
+		control: control,
+	}
+}
+
+func (a *Admin) Register(mux *http.ServeMux) {
+	mux.HandleFunc("POST /admin/relist", a.auth(a.postRelist))
+	mux.HandleFunc("POST /admin/pause", a.auth(a.postPause))
+	mux.HandleFunc("POST /admin/resume", a.auth(a.postResume))
+	mux.HandleFunc("POST /admin/retry", a.auth(a.postRetry))
+	mux.HandleFunc("GET /admin/status", a.auth(a.getStatus))
+}
+
+func (a *Admin) auth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (a *Admin) respond(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		a.logger.Warn("Failed to write admin response", zap.Error(err))
+	}
+}
+
+func (a *Admin) postRelist(w http.ResponseWriter, r *http.Request) {
+	a.logger.Info("Admin requested inbox re-list")
+	a.control.Relist()
+	a.respond(w, http.StatusAccepted, map[string]string{"relist": "requested"})
+}
+
+func (a *Admin) postPause(w http.ResponseWriter, r *http.Request) {
+	a.logger.Info("Admin paused notification processing")
+	a.control.SetPaused(true)
+	a.respond(w, http.StatusOK, a.control.Status())
+}
+
+func (a *Admin) postResume(w http.ResponseWriter, r *http.Request) {
+	a.logger.Info("Admin resumed notification processing")
+	a.control.SetPaused(false)
+	a.respond(w, http.StatusOK, a.control.Status())
+}
+
+func (a *Admin) postRetry(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "key query parameter required", http.StatusBadRequest)
+		return
+	}
+	if !a.control.Retry(key) {
+		http.Error(w, "too many retries queued", http.StatusServiceUnavailable)
+		return
+	}
+	a.logger.Info("Admin requested retry", zap.String("key", key))
+	a.respond(w, http.StatusAccepted, map[string]string{"retry": key})
+}
+
+func (a *Admin) getStatus(w http.ResponseWriter, r *http.Request) {
+	a.respond(w, http.StatusOK, a.control.Status())
+}
@@ -0,0 +1,94 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+	"repos.se/minio-deduplication/v2/pkg/admin"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+)
+
+func TestAdmin(t *testing.T) {
+	control := admin.NewControl()
+	mux := http.NewServeMux()
+	admin.New(zaptest.NewLogger(t), "s3cret", control).Register(mux)
+
+	request := func(method, target, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := request("POST", "/admin/pause", ""); w.Code != 401 {
+		t.Errorf("Expected 401 without token, got %d", w.Code)
+	}
+	if w := request("POST", "/admin/pause", "wrong"); w.Code != 401 {
+		t.Errorf("Expected 401 with wrong token, got %d", w.Code)
+	}
+	if control.Paused() {
+		t.Error("Should not pause without auth")
+	}
+
+	if w := request("POST", "/admin/pause", "s3cret"); w.Code != 200 {
+		t.Errorf("Unexpected pause status %d", w.Code)
+	}
+	if !control.Paused() {
+		t.Error("Expected paused")
+	}
+	select {
+	case <-control.Changed():
+	default:
+		t.Error("Expected a change signal on pause")
+	}
+	request("POST", "/admin/resume", "s3cret")
+	if control.Paused() {
+		t.Error("Expected resumed")
+	}
+
+	request("POST", "/admin/relist", "s3cret")
+	request("POST", "/admin/relist", "s3cret")
+	<-control.Relists()
+	select {
+	case <-control.Relists():
+		t.Error("Expected relist requests to coalesce")
+	default:
+	}
+
+	if w := request("POST", "/admin/retry", "s3cret"); w.Code != 400 {
+		t.Errorf("Expected 400 for retry without key, got %d", w.Code)
+	}
+	if w := request("POST", "/admin/retry?key=dir%2Ffile.txt", "s3cret"); w.Code != 202 {
+		t.Errorf("Unexpected retry status %d", w.Code)
+	}
+	if key := <-control.Retries(); key != "dir/file.txt" {
+		t.Errorf("Unexpected retry key %s", key)
+	}
+
+	done := control.Begin("a.txt", "notification")
+	control.SetPending(func() []bucket.PendingAck {
+		return []bucket.PendingAck{{Source: "topic/0@1", Keys: []string{"inbox/a.txt"}, Received: time.Now()}}
+	})
+	w := request("GET", "/admin/status", "s3cret")
+	var status admin.Status
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Inflight) != 1 || status.Inflight[0].Key != "a.txt" {
+		t.Errorf("Unexpected inflight %v", status.Inflight)
+	}
+	if len(status.Pending) != 1 || status.Pending[0].Source != "topic/0@1" {
+		t.Errorf("Unexpected pending %v", status.Pending)
+	}
+	done()
+	if len(control.Inflight()) != 0 {
+		t.Error("Expected no inflight after done")
+	}
+}
@@ -0,0 +1,140 @@
+package admin
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+)
+
+type Inflight struct {
+	Key     string    `json:"key"`
+	Trigger string    `json:"trigger"`
+	Started time.Time `json:"started"`
+}
+
+type Status struct {
+	Paused   bool                `json:"paused"`
+	Inflight []Inflight          `json:"inflight"`
+	Pending  []bucket.PendingAck `json:"pending"`
+}
+
+// Control is the processing state that operators can inspect and change
+type Control struct {
+	mu       sync.Mutex
+	paused   bool
+	changed  chan struct{}
+	relists  chan struct{}
+	retries  chan string
+	inflight map[int64]Inflight
+	seq      int64
+	pending  func() []bucket.PendingAck
+}
+
+func NewControl() *Control {
+	return &Control{
+		changed:  make(chan struct{}, 1),
+		relists:  make(chan struct{}, 1),
+		retries:  make(chan string, 100),
+		inflight: make(map[int64]Inflight),
+	}
+}
+
+func (c *Control) signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Changed signals that Paused may have a new value
+func (c *Control) Changed() <-chan struct{} {
+	return c.changed
+}
+
+func (c *Control) Paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
+
+func (c *Control) SetPaused(paused bool) {
+	c.mu.Lock()
+	c.paused = paused
+	c.mu.Unlock()
+	c.signal(c.changed)
+}
+
+// Relists signals requested inbox listings, coalescing requests that arrive during a listing
+func (c *Control) Relists() <-chan struct{} {
+	return c.relists
+}
+
+func (c *Control) Relist() {
+	c.signal(c.relists)
+}
+
+func (c *Control) Retries() <-chan string {
+	return c.retries
+}
+
+// Retry returns false if too many retries are already queued
+func (c *Control) Retry(key string) bool {
+	select {
+	case c.retries <- key:
+		return true
+	default:
+		return false
+	}
+}
+
+// Begin tracks an in-flight transfer until the returned func is called
+func (c *Control) Begin(key, trigger string) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	id := c.seq
+	c.inflight[id] = Inflight{Key: key, Trigger: trigger, Started: time.Now()}
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.inflight, id)
+	}
+}
+
+func (c *Control) Inflight() []Inflight {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inflight := make([]Inflight, 0, len(c.inflight))
+	for _, i := range c.inflight {
+		inflight = append(inflight, i)
+	}
+	sort.Slice(inflight, func(a, b int) bool {
+		return inflight[a].Started.Before(inflight[b].Started)
+	})
+	return inflight
+}
+
+// SetPending sets the watcher's pending acks source, nil if the watcher doesn't track acks
+func (c *Control) SetPending(pending func() []bucket.PendingAck) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = pending
+}
+
+func (c *Control) Status() Status {
+	c.mu.Lock()
+	paused := c.paused
+	pending := c.pending
+	c.mu.Unlock()
+	status := Status{
+		Paused:   paused,
+		Inflight: c.Inflight(),
+		Pending:  []bucket.PendingAck{},
+	}
+	if pending != nil {
+		status.Pending = pending()
+	}
+	return status
+}
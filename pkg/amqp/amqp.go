@@ -0,0 +1,300 @@
+package amqp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/prometheus/client_golang/prometheus"
+	amqp091 "github.com/rabbitmq/amqp091-go"
+	"go.uber.org/zap"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+	"repos.se/minio-deduplication/v2/pkg/kafka"
+)
+
+const (
+	prefetchDefault = 10
+	consumerTag     = "minio-deduplication"
+)
+
+type AmqpConsumerConfig struct {
+	Logger *zap.Logger
+	Url    string
+	Queue  string
+	// Exchange, if set, is where MinIO publishes; the queue is then declared durable and bound with RoutingKey
+	Exchange   string
+	RoutingKey string
+	// ExchangeType, if set, declares the exchange durable, because MinIO declares it only on first publish
+	ExchangeType string
+	// DeadLetterExchange is set as x-dead-letter-exchange when the queue is declared, and gets rejected deliveries.
+	// It requires Exchange, as an existing queue's arguments can't be changed.
+	DeadLetterExchange string
+	// Prefetch is the max unacked deliveries, i.e. our backpressure, zero for default
+	Prefetch int
+	// Filter is on the event's Key, which MinIO sets to bucket/key
+	Filter kafka.MessageFilter
+}
+
+type AmqpAckPending struct {
+	delivery amqp091.Delivery
+	info     *notification.Info
+	received time.Time
+}
+
+// AmqpAcks maps transfer results to ack, or to reject without requeue which routes to the dead letter exchange
+type AmqpAcks struct {
+	logger        *zap.Logger
+	mu            sync.Mutex
+	pending       map[bucket.Delivery]*AmqpAckPending
+	metricPending prometheus.Gauge
+	metricAcks    *prometheus.CounterVec
+}
+
+func NewAmqpAcks(logger *zap.Logger, metricPending prometheus.Gauge, metricAcks *prometheus.CounterVec) *AmqpAcks {
+	return &AmqpAcks{
+		logger:        logger,
+		pending:       make(map[bucket.Delivery]*AmqpAckPending),
+		metricPending: metricPending,
+		metricAcks:    metricAcks,
+	}
+}
+
+// Expect requires a notification with records, as they identify its delivery
+func (a *AmqpAcks) Expect(delivery amqp091.Delivery, info *notification.Info) {
+	a.mu.Lock()
+	a.pending[bucket.DeliveryOf(info)] = &AmqpAckPending{delivery: delivery, info: info, received: time.Now()}
+	a.mu.Unlock()
+	a.metricPending.Inc()
+}
+
+// remove returns the pending delivery, or nil if the notification isn't pending
+func (a *AmqpAcks) remove(info *notification.Info) *AmqpAckPending {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p, found := a.pending[bucket.DeliveryOf(info)]
+	if !found {
+		return nil
+	}
+	delete(a.pending, bucket.DeliveryOf(info))
+	a.metricPending.Dec()
+	return p
+}
+
+func (a *AmqpAcks) Ack(_ context.Context, result bucket.TransferResult, info *notification.Info) {
+	p := a.remove(info)
+	if p == nil {
+		a.logger.Warn("Ack for a delivery that isn't pending, ignoring", zap.Any("info", info))
+		return
+	}
+	delivery := p.delivery
+	if result == bucket.TransferOk {
+		a.respond(delivery, "ack", delivery.Ack(false))
+	} else {
+		a.respond(delivery, "reject", delivery.Reject(false))
+	}
+}
+
+// Forget is for notifications that won't be acked, at a stop, and requeues them for a prompt redelivery
+func (a *AmqpAcks) Forget(info *notification.Info) {
+	if p := a.remove(info); p != nil {
+		a.respond(p.delivery, "requeue", p.delivery.Nack(false, true))
+	}
+}
+
+// Reject is for deliveries that weren't emitted because they can't be processed
+func (a *AmqpAcks) Reject(delivery amqp091.Delivery, reason string) {
+	a.logger.Warn("Rejecting delivery", zap.Uint64("tag", delivery.DeliveryTag), zap.String("reason", reason))
+	a.respond(delivery, "reject", delivery.Reject(false))
+}
+
+func (a *AmqpAcks) respond(delivery amqp091.Delivery, action string, err error) {
+	a.metricAcks.With(prometheus.Labels{"action": action}).Inc()
+	if err != nil {
+		// the channel is likely closed, and the broker requeues unacked deliveries
+		a.logger.Error("Failed to respond to delivery",
+			zap.String("action", action),
+			zap.Uint64("tag", delivery.DeliveryTag),
+			zap.Error(err),
+		)
+	}
+}
+
+func (a *AmqpAcks) PendingSize() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.pending)
+}
+
+func (a *AmqpAcks) Pending() []bucket.PendingAck {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pending := make([]bucket.PendingAck, 0, len(a.pending))
+	for _, p := range a.pending {
+		keys := make([]string, 0, len(p.info.Records))
+		for _, r := range p.info.Records {
+			keys = append(keys, r.S3.Object.Key)
+		}
+		pending = append(pending, bucket.PendingAck{
+			Source:   fmt.Sprintf("%s#%d", p.delivery.RoutingKey, p.delivery.DeliveryTag),
+			Keys:     keys,
+			Received: p.received,
+		})
+	}
+	bucket.SortPending(pending)
+	return pending
+}
+
+// declare sets up the queue if we know the exchange, or else verifies that it exists
+func declare(ch *amqp091.Channel, config *AmqpConsumerConfig) error {
+	if config.Exchange == "" {
+		_, err := ch.QueueDeclarePassive(config.Queue, true, false, false, false, nil)
+		return err
+	}
+	args := amqp091.Table{}
+	if config.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = config.DeadLetterExchange
+	}
+	if config.ExchangeType != "" {
+		if err := ch.ExchangeDeclare(config.Exchange, config.ExchangeType, true, false, false, false, nil); err != nil {
+			return err
+		}
+	}
+	if _, err := ch.QueueDeclare(config.Queue, true, false, false, false, args); err != nil {
+		return err
+	}
+	return ch.QueueBind(config.Queue, config.RoutingKey, config.Exchange, false, nil)
+}
+
+// NewAmqp consumes with manual acks until ctx is cancelled, while acks and Close use their own contexts.
+// A lost connection ends Uploads with bucket.ErrConnectionLost, as reconnecting would invalidate pending delivery tags.
+func NewAmqp(ctx context.Context, config *AmqpConsumerConfig) *bucket.InboxWatcher {
+	logger := config.Logger
+	if config.DeadLetterExchange != "" && config.Exchange == "" {
+		logger.Fatal("AMQP dead letter exchange requires an exchange to declare the queue with",
+			zap.String("queue", config.Queue),
+			zap.String("deadLetterExchange", config.DeadLetterExchange),
+		)
+	}
+	filter := kafka.NewKeyFilterPredicate(config.Filter, logger)
+	if config.Prefetch == 0 {
+		config.Prefetch = prefetchDefault
+	}
+	acks := NewAmqpAcks(logger,
+		bucket.Registered(prometheus.NewGauge(bucket.PendingGaugeOpts)),
+		bucket.Registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "blobs_watch_amqp_acks",
+			Help: "Responses to AMQP deliveries, by action ack, reject or requeue",
+		}, []string{"action"})),
+	)
+
+	var contact bucket.Contact
+
+	conn, err := amqp091.DialConfig(config.Url, amqp091.Config{
+		Properties: amqp091.Table{"connection_name": "minio-deduplication"},
+	})
+	if err != nil {
+		logger.Fatal("AMQP connection failure", zap.Error(err))
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		logger.Fatal("AMQP channel failure", zap.Error(err))
+	}
+	if err := ch.Qos(config.Prefetch, 0, false); err != nil {
+		logger.Fatal("AMQP prefetch failure", zap.Int("prefetch", config.Prefetch), zap.Error(err))
+	}
+	if err := declare(ch, config); err != nil {
+		logger.Fatal("AMQP queue failure",
+			zap.String("queue", config.Queue),
+			zap.String("exchange", config.Exchange),
+			zap.String("deadLetterExchange", config.DeadLetterExchange),
+			zap.Error(err),
+		)
+	}
+	deliveries, err := ch.Consume(config.Queue, consumerTag, false, false, false, false, nil)
+	if err != nil {
+		logger.Fatal("AMQP consume failure", zap.String("queue", config.Queue), zap.Error(err))
+	}
+	logger.Info("AMQP consumer started", zap.String("queue", config.Queue), zap.Int("prefetch", config.Prefetch))
+
+	uploads := make(chan notification.Info)
+	result := &bucket.InboxWatcher{
+		Uploads:  uploads,
+		Ack:      acks.Ack,
+		Pending:  acks.Pending,
+		Abandon:  acks.Forget,
+		LastSeen: contact.LastSeen,
+		Close: func(context.Context) {
+			logger.Info("Closing AMQP connection", zap.Int("pending", acks.PendingSize()))
+			// unacked deliveries are requeued by the broker
+			if err := conn.Close(); err != nil && err != amqp091.ErrClosed {
+				logger.Error("AMQP close failed", zap.Error(err))
+			}
+		},
+	}
+
+	go func() {
+		contact.Heartbeat(ctx, func() bool {
+			return !conn.IsClosed()
+		})
+		// stops deliveries, while the channel stays open for acks
+		if err := ch.Cancel(consumerTag, false); err != nil {
+			logger.Warn("AMQP cancel failed", zap.Error(err))
+		}
+	}()
+
+	go func(notificationInfoCh chan<- notification.Info) {
+		defer close(notificationInfoCh)
+		for {
+			var delivery amqp091.Delivery
+			var ok bool
+			select {
+			case <-ctx.Done():
+				logger.Info("AMQP consumer stopped")
+				return
+			case delivery, ok = <-deliveries:
+			}
+			if !ok {
+				logger.Error("AMQP deliveries ended, the connection or channel was closed")
+				bucket.SendLost(ctx, notificationInfoCh, amqp091.ErrClosed)
+				return
+			}
+			contact.Seen()
+			var event bucket.Event
+			if err := json.Unmarshal(delivery.Body, &event); err != nil {
+				logger.Error("Failed to unmarshal notification",
+					zap.String("routingKey", delivery.RoutingKey),
+					zap.ByteString("body", delivery.Body),
+					zap.Error(err),
+				)
+				acks.Reject(delivery, fmt.Sprintf("unmarshal: %s", err))
+				continue
+			}
+			if !filter(event.Key) {
+				logger.Debug("Filtered out", zap.String("key", event.Key))
+				if err := delivery.Ack(false); err != nil {
+					logger.Warn("Failed to ack filtered delivery", zap.Error(err))
+				}
+				continue
+			}
+			if len(event.Records) == 0 {
+				logger.Error("Got notification with zero records", zap.ByteString("body", delivery.Body))
+				acks.Reject(delivery, "zero records")
+				continue
+			}
+			logger.Info("Got notification", zap.String("routingKey", delivery.RoutingKey), zap.String("key", event.Key))
+			notificationInfo := notification.Info{Records: event.Records}
+			acks.Expect(delivery, &notificationInfo)
+			select {
+			case notificationInfoCh <- notificationInfo:
+			case <-ctx.Done():
+				// never emitted so never acked
+				acks.Forget(&notificationInfo)
+			}
+		}
+	}(uploads)
+
+	return result
+}
@@ -0,0 +1,107 @@
+package amqp_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	amqp091 "github.com/rabbitmq/amqp091-go"
+	"go.uber.org/zap/zaptest"
+	"repos.se/minio-deduplication/v2/pkg/amqp"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+)
+
+type testAcknowledger struct {
+	acked    []uint64
+	rejected []uint64
+	requeued bool
+}
+
+func (a *testAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = append(a.acked, tag)
+	return nil
+}
+
+func (a *testAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.rejected = append(a.rejected, tag)
+	a.requeued = a.requeued || requeue
+	return nil
+}
+
+func (a *testAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.rejected = append(a.rejected, tag)
+	a.requeued = a.requeued || requeue
+	return nil
+}
+
+func TestAcks(t *testing.T) {
+
+	ctx := context.TODO()
+	pending := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_pending"})
+	actions := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_acks"}, []string{"action"})
+	acks := amqp.NewAmqpAcks(zaptest.NewLogger(t), pending, actions)
+	acknowledger := &testAcknowledger{}
+
+	newInfo := func(sequencer string) notification.Info {
+		info := notification.Info{Records: make([]notification.Event, 1)}
+		info.Records[0].S3.Object.Key = "file.txt"
+		info.Records[0].S3.Object.Sequencer = sequencer
+		return info
+	}
+	ok, failed := newInfo("s1"), newInfo("s2")
+	acks.Expect(amqp091.Delivery{Acknowledger: acknowledger, DeliveryTag: 1, RoutingKey: "minio"}, &ok)
+	acks.Expect(amqp091.Delivery{Acknowledger: acknowledger, DeliveryTag: 2, RoutingKey: "minio"}, &failed)
+	if len(acks.Pending()) != 2 || acks.Pending()[1].Source != "minio#2" {
+		t.Errorf("Unexpected pending %v", acks.Pending())
+	}
+
+	// copies, like those that went through the channel, acked out of order
+	failedCopy := failed
+	acks.Ack(ctx, bucket.TransferFailed, &failedCopy)
+	okCopy := ok
+	acks.Ack(ctx, bucket.TransferOk, &okCopy)
+	acks.Ack(ctx, bucket.TransferOk, &okCopy)
+
+	if len(acknowledger.acked) != 1 || acknowledger.acked[0] != 1 {
+		t.Errorf("Expected an ack of tag 1, got %v", acknowledger.acked)
+	}
+	if len(acknowledger.rejected) != 1 || acknowledger.rejected[0] != 2 {
+		t.Errorf("Expected a reject of tag 2, got %v", acknowledger.rejected)
+	}
+	if acknowledger.requeued {
+		t.Error("Failed transfers should be rejected without requeue, for dead lettering")
+	}
+	if acks.PendingSize() != 0 || testutil.ToFloat64(pending) != 0 {
+		t.Errorf("Expected nothing pending, got %d", acks.PendingSize())
+	}
+	if testutil.ToFloat64(actions.WithLabelValues("reject")) != 1 {
+		t.Error("Expected the reject to be counted")
+	}
+
+}
+
+func TestAcksForget(t *testing.T) {
+
+	pending := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_pending"})
+	actions := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_acks"}, []string{"action"})
+	acks := amqp.NewAmqpAcks(zaptest.NewLogger(t), pending, actions)
+	acknowledger := &testAcknowledger{}
+
+	// without a sequencer the records are identical, and deliveries are told apart by the notification they emitted
+	first := notification.Info{Records: make([]notification.Event, 1)}
+	second := notification.Info{Records: make([]notification.Event, 1)}
+	acks.Expect(amqp091.Delivery{Acknowledger: acknowledger, DeliveryTag: 1}, &first)
+	acks.Expect(amqp091.Delivery{Acknowledger: acknowledger, DeliveryTag: 2}, &second)
+	secondCopy := second
+	acks.Forget(&secondCopy)
+
+	if len(acknowledger.rejected) != 1 || acknowledger.rejected[0] != 2 || !acknowledger.requeued {
+		t.Errorf("Expected a requeue of tag 2, got %v", acknowledger.rejected)
+	}
+	if acks.PendingSize() != 1 || testutil.ToFloat64(pending) != 1 {
+		t.Errorf("Expected the first delivery still pending, got %d", acks.PendingSize())
+	}
+
+}
@@ -0,0 +1,44 @@
+package bucket
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// HeartbeatInterval is how often watchers check their connection while there are no notifications, to report contact
+const HeartbeatInterval = time.Duration(time.Second * 10)
+
+// Contact is a watcher's latest contact with its notification source, for InboxWatcher.LastSeen
+type Contact struct {
+	last atomic.Int64
+}
+
+// Seen records contact now
+func (c *Contact) Seen() {
+	c.last.Store(time.Now().UnixNano())
+}
+
+// LastSeen is zero before the first contact
+func (c *Contact) LastSeen() time.Time {
+	if nanos := c.last.Load(); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
+// Heartbeat records contact whenever check succeeds, at start and then every HeartbeatInterval, until ctx is done
+func (c *Contact) Heartbeat(ctx context.Context, check func() bool) {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		if check() {
+			c.Seen()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
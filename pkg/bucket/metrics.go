@@ -0,0 +1,29 @@
+package bucket
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PendingGaugeOpts is for the gauge that watchers which track acks keep their pending count in
+var PendingGaugeOpts = prometheus.GaugeOpts{
+	Name: "blobs_watch_acks_pending",
+	Help: "Notifications emitted but not yet acked for on the consumer",
+}
+
+// Registered registers c with the default registry, or returns the equal collector that is already registered.
+// Watchers use it for their metrics, as they are created again when mainMinio re-runs.
+func Registered[T prometheus.Collector](c T) T {
+	err := prometheus.Register(c)
+	if err == nil {
+		return c
+	}
+	var already prometheus.AlreadyRegisteredError
+	if errors.As(err, &already) {
+		if existing, ok := already.ExistingCollector.(T); ok {
+			return existing
+		}
+	}
+	panic(err)
+}
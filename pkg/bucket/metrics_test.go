@@ -0,0 +1,30 @@
+package bucket_test
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+)
+
+func TestRegistered(t *testing.T) {
+	opts := prometheus.CounterOpts{Name: "test_registered", Help: "Created once per watcher run"}
+	first := bucket.Registered(prometheus.NewCounter(opts))
+	first.Inc()
+	second := bucket.Registered(prometheus.NewCounter(opts))
+	second.Inc()
+	if first != second {
+		t.Error("Expected the registered counter to be reused")
+	}
+	if value := testutil.ToFloat64(second); value != 2 {
+		t.Errorf("Expected the count to survive a re-run, got %f", value)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for a different collector with the same name")
+		}
+	}()
+	bucket.Registered(prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_registered", Help: "Created once per watcher run"}))
+}
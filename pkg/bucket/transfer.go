@@ -1,8 +1,51 @@
 package bucket
 
+import (
+	"context"
+	"time"
+)
+
 type TransferResult int8
 
 const (
 	TransferFailed TransferResult = iota
 	TransferOk
 )
+
+// TransferOutcome is what happened to an inbox item, as reported to downstream consumers
+type TransferOutcome string
+
+const (
+	OutcomeArchived  TransferOutcome = "archived"
+	OutcomeDuplicate TransferOutcome = "duplicate"
+	OutcomeDropped   TransferOutcome = "dropped"
+	OutcomeFailed    TransferOutcome = "failed"
+	// OutcomeGone is an upload no longer in the inbox, typically a redelivered notification, which is a no-op
+	OutcomeGone TransferOutcome = "gone"
+	// OutcomeQuarantined is an upload moved to the quarantine bucket, see Reason
+	OutcomeQuarantined TransferOutcome = "quarantined"
+	// OutcomeIgnored is an upload left in the inbox by policy, which like gone is a no-op
+	OutcomeIgnored TransferOutcome = "ignored"
+)
+
+type TransferEvent struct {
+	Outcome TransferOutcome `json:"outcome"`
+	// Upload is the original upload path
+	Upload string `json:"upload"`
+	// Key is the blob key in the archive, empty on drop or failure
+	Key string `json:"key"`
+	// Etag is the blob etag, empty on drop
+	Etag string `json:"etag,omitempty"`
+	// Meta is the blob metadata written
+	Meta map[string]string `json:"meta,omitempty"`
+	// Error describes a failure
+	Error string `json:"error,omitempty"`
+	// Reason is why an upload was dropped, quarantined or ignored rather than archived
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// TransferSink gets every transfer outcome before the notification that triggered it is acked
+type TransferSink interface {
+	Publish(ctx context.Context, event *TransferEvent) error
+}
@@ -2,11 +2,76 @@ package bucket
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
 
 	"github.com/minio/minio-go/v7/pkg/notification"
 )
 
+// Event is MinIO's event.Log, which unlike the ListenBucketNotification payload has a Key.
+// It's what queue and webhook targets get.
+type Event struct {
+	EventName string               `json:"EventName"`
+	Key       string               `json:"Key"`
+	Records   []notification.Event `json:"Records"`
+}
+
+// ErrConnectionLost ends a watcher's Uploads when it can't go on, so that a re-run connects again
+var ErrConnectionLost = errors.New("notification source connection lost")
+
+// SendLost is a watcher's last notification when it lost its connection, unless ctx is done
+func SendLost(ctx context.Context, uploads chan<- notification.Info, cause error) {
+	select {
+	case uploads <- notification.Info{Err: fmt.Errorf("%w: %w", ErrConnectionLost, cause)}:
+	case <-ctx.Done():
+	}
+}
+
 type InboxWatcher struct {
 	Uploads <-chan notification.Info
 	Ack     func(context.Context, TransferResult, *notification.Info)
+	// Pending is nil for watchers that don't track acks
+	Pending func() []PendingAck
+	// LastSeen is the latest contact with the notification source, nil for watchers that can't tell
+	LastSeen func() time.Time
+	// Close is called after the last ack, nil if there's nothing to clean up
+	Close func(context.Context)
+	// Begin is called before processing, false means the notification is stale and must be neither processed nor acked.
+	// Nil means always true.
+	Begin func(*notification.Info) bool
+	// Abandon is called at a stop for a notification that may have begun but won't be acked, so it's redelivered.
+	// Nil if there's nothing to release.
+	Abandon func(*notification.Info)
+}
+
+// Delivery identifies a notification as emitted by a watcher, also after it's copied through the Uploads channel,
+// as copies share their records. Nil for a notification without records, which has nothing to ack.
+type Delivery *notification.Event
+
+// DeliveryOf is the identity for watchers to match acks with what they emitted
+func DeliveryOf(info *notification.Info) Delivery {
+	if len(info.Records) == 0 {
+		return nil
+	}
+	return &info.Records[0]
+}
+
+// PendingAck describes a notification that has been emitted but not yet acked
+type PendingAck struct {
+	// Source identifies the notification in the watcher's terms, for example topic, partition and offset
+	Source   string    `json:"source"`
+	Keys     []string  `json:"keys"`
+	Received time.Time `json:"received"`
+}
+
+// SortPending orders pending acks oldest first, for watchers that track them by delivery
+func SortPending(pending []PendingAck) {
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].Received.Equal(pending[j].Received) {
+			return pending[i].Source < pending[j].Source
+		}
+		return pending[i].Received.Before(pending[j].Received)
+	})
 }
@@ -0,0 +1,25 @@
+package bucket_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+)
+
+func TestSendLost(t *testing.T) {
+	uploads := make(chan notification.Info, 1)
+	bucket.SendLost(context.Background(), uploads, io.EOF)
+	info := <-uploads
+	if !errors.Is(info.Err, bucket.ErrConnectionLost) || !errors.Is(info.Err, io.EOF) {
+		t.Errorf("Expected the sentinel with its cause, got %v", info.Err)
+	}
+
+	// a stopped consumer doesn't read it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	bucket.SendLost(ctx, make(chan notification.Info), io.EOF)
+}
@@ -0,0 +1,138 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type HealthConfig struct {
+	Logger *zap.Logger
+	// RequireWatcher is false in batch mode
+	RequireWatcher bool
+	// StallAfter is how long a transfer may be in flight before we consider the process wedged
+	StallAfter time.Duration
+	// SilentAfter is how long a watcher that reports contact may go without it
+	SilentAfter time.Duration
+	// OldestInflight returns the start time of the oldest in-flight transfer, false if there is none
+	OldestInflight func() (time.Time, bool)
+}
+
+// Health backs /healthz (liveness) and /readyz (readiness)
+type Health struct {
+	config       *HealthConfig
+	mu           sync.Mutex
+	buckets      bool
+	watcher      string
+	lastSeen     func() time.Time
+	lastProgress time.Time
+}
+
+type Report struct {
+	Ok     bool              `json:"ok"`
+	Checks map[string]string `json:"checks"`
+}
+
+func New(config *HealthConfig) *Health {
+	return &Health{config: config}
+}
+
+func (h *Health) SetBucketsConfirmed(confirmed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buckets = confirmed
+}
+
+// SetWatcher with an empty name means disconnected, lastSeen is nil for watchers that can't report contact
+func (h *Health) SetWatcher(name string, lastSeen func() time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.watcher = name
+	h.lastSeen = lastSeen
+}
+
+// Progress records that a notification was received
+func (h *Health) Progress() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastProgress = time.Now()
+}
+
+// Live fails if we're stuck in a way that a restart is likely to fix
+func (h *Health) Live() Report {
+	h.mu.Lock()
+	watcher := h.watcher
+	lastSeen := h.lastSeen
+	h.mu.Unlock()
+	r := Report{Ok: true, Checks: make(map[string]string)}
+	now := time.Now()
+	if oldest, found := h.config.OldestInflight(); found && now.Sub(oldest) > h.config.StallAfter {
+		r.Ok = false
+		r.Checks["transfers"] = fmt.Sprintf("stalled, oldest in flight since %s", oldest.UTC().Format(time.RFC3339))
+	} else {
+		r.Checks["transfers"] = "ok"
+	}
+	if watcher != "" && lastSeen != nil {
+		if seen := lastSeen(); !seen.IsZero() && now.Sub(seen) > h.config.SilentAfter {
+			r.Ok = false
+			r.Checks["watcher"] = fmt.Sprintf("%s silent since %s", watcher, seen.UTC().Format(time.RFC3339))
+		}
+	}
+	return r
+}
+
+// Ready adds to Live that buckets are confirmed and the watcher is connected
+func (h *Health) Ready() Report {
+	r := h.Live()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.buckets {
+		r.Checks["buckets"] = "ok"
+	} else {
+		r.Ok = false
+		r.Checks["buckets"] = "not confirmed"
+	}
+	if !h.config.RequireWatcher {
+		return r
+	}
+	if h.watcher == "" {
+		r.Ok = false
+		r.Checks["watcher"] = "not connected"
+		return r
+	}
+	if h.lastSeen != nil && h.lastSeen().IsZero() {
+		r.Ok = false
+		r.Checks["watcher"] = fmt.Sprintf("%s not yet in contact", h.watcher)
+		return r
+	}
+	if _, reported := r.Checks["watcher"]; !reported {
+		r.Checks["watcher"] = h.watcher
+		if !h.lastProgress.IsZero() {
+			r.Checks["watcher"] += fmt.Sprintf(", last notification %s", h.lastProgress.UTC().Format(time.RFC3339))
+		}
+	}
+	return r
+}
+
+func (h *Health) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", h.handler(h.Live))
+	mux.HandleFunc("GET /readyz", h.handler(h.Ready))
+}
+
+func (h *Health) handler(report func() Report) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := report()
+		w.Header().Set("Content-Type", "application/json")
+		if result.Ok {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			h.config.Logger.Warn("Health check failed", zap.String("path", r.URL.Path), zap.Any("checks", result.Checks))
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
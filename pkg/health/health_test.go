@@ -0,0 +1,81 @@
+package health_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+	"repos.se/minio-deduplication/v2/pkg/health"
+)
+
+func TestHealth(t *testing.T) {
+	var oldest time.Time
+	h := health.New(&health.HealthConfig{
+		Logger:         zaptest.NewLogger(t),
+		RequireWatcher: true,
+		StallAfter:     time.Minute,
+		SilentAfter:    time.Minute,
+		OldestInflight: func() (time.Time, bool) {
+			return oldest, !oldest.IsZero()
+		},
+	})
+	mux := http.NewServeMux()
+	h.Register(mux)
+	status := func(path string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	if status("/healthz") != 200 {
+		t.Error("Expected live at start")
+	}
+	if status("/readyz") != 503 {
+		t.Error("Expected not ready before bucket confirmation")
+	}
+
+	h.SetBucketsConfirmed(true)
+	if status("/readyz") != 503 {
+		t.Error("Expected not ready without watcher")
+	}
+
+	var seen time.Time
+	h.SetWatcher("kafka", func() time.Time { return seen })
+	if status("/readyz") != 503 {
+		t.Error("Expected not ready before watcher contact")
+	}
+	seen = time.Now()
+	if status("/readyz") != 200 {
+		t.Error("Expected ready after watcher contact")
+	}
+
+	seen = time.Now().Add(-2 * time.Minute)
+	if status("/healthz") != 503 {
+		t.Error("Expected not live with a silent watcher")
+	}
+	seen = time.Now()
+
+	oldest = time.Now().Add(-2 * time.Minute)
+	if status("/healthz") != 503 {
+		t.Error("Expected not live with a stalled transfer")
+	}
+	if status("/readyz") != 503 {
+		t.Error("Expected not ready with a stalled transfer")
+	}
+	oldest = time.Time{}
+
+	h.SetWatcher("", nil)
+	if status("/healthz") != 200 {
+		t.Error("Expected live while reconnecting")
+	}
+	if status("/readyz") != 503 {
+		t.Error("Expected not ready while reconnecting")
+	}
+
+	h.SetWatcher("listen", nil)
+	if status("/readyz") != 200 {
+		t.Error("Expected ready with a watcher that can't report contact")
+	}
+}
@@ -1,15 +1,29 @@
 package index
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/minio/minio-go/v7"
 	"repos.se/minio-deduplication/v2/pkg/metadata"
 )
 
+// EntryKind is empty for transfers and for drops of empty files, the only kinds in early indexes
+type EntryKind string
+
+const (
+	// KindDropped is an upload removed from the inbox by policy
+	KindDropped EntryKind = "dropped"
+	// KindQuarantined is an upload moved to the quarantine bucket by policy
+	KindQuarantined EntryKind = "quarantined"
+	// KindLeft is an upload that policy left in the inbox
+	KindLeft EntryKind = "left"
+)
+
 type IndexEntry struct {
 	IndexFormatVersion int8 `json:"v"`
 	// Upload is the original uploadPath
@@ -24,9 +38,13 @@ type IndexEntry struct {
 	Etag string `json:"etag"`
 	// Meta is the metadata written
 	Meta map[string]string `json:"meta"`
+	// Kind and Reason are set for uploads that a policy rejected
+	Kind   EntryKind `json:"kind,omitempty"`
+	Reason string    `json:"reason,omitempty"`
 }
 
 type Index struct {
+	mu      sync.RWMutex
 	entries []IndexEntry
 }
 
@@ -35,13 +53,30 @@ func New() *Index {
 }
 
 func (i *Index) Size() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
 	return len(i.entries)
 }
 
 func (i *Index) Append(entry IndexEntry) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
 	i.entries = append(i.entries, entry)
 }
 
+// LookupUpload returns the latest entry for an upload path, with an empty Key if dropped or quarantined.
+// Uploads left in the inbox are not found.
+func (i *Index) LookupUpload(uploadKey string) (IndexEntry, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	for n := len(i.entries) - 1; n >= 0; n-- {
+		if i.entries[n].Upload == uploadKey && i.entries[n].Kind != KindLeft {
+			return i.entries[n], true
+		}
+	}
+	return IndexEntry{}, false
+}
+
 func (i *Index) AppendTransfer(uploadKey string, dstInfo minio.UploadInfo, replaced bool, meta *metadata.MetadataNext) {
 	// note that dstInfo.Size is zero because we did a copy
 	i.Append(IndexEntry{
@@ -67,29 +102,75 @@ func (i *Index) AppendDrop(uploadKey string) {
 	})
 }
 
-// Serialize returns what to write and the content-type, or error
-func (i *Index) Serialize(contentType string) (io.Reader, int64, error) {
+// AppendRejected records an upload that a policy rejected, with the kind matching the policy's action,
+// and meta if it was written to the quarantine bucket
+func (i *Index) AppendRejected(uploadKey string, kind EntryKind, reason string, meta map[string]string) {
+	i.Append(IndexEntry{
+		IndexFormatVersion: 1,
+		Upload:             uploadKey,
+		Kind:               kind,
+		Reason:             reason,
+		Meta:               meta,
+	})
+}
+
+// Truncate removes the first n entries, once they're written, so that a long running process doesn't accumulate them
+func (i *Index) Truncate(n int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.entries = append([]IndexEntry{}, i.entries[min(n, len(i.entries)):]...)
+}
+
+// Find returns the latest entry for an upload path in a serialized index, like LookupUpload, nil if there's none
+func Find(r io.Reader, uploadKey string) (*IndexEntry, error) {
+	// most lines are other uploads, which needn't be parsed
+	quoted, err := json.Marshal(uploadKey)
+	if err != nil {
+		return nil, err
+	}
+	var found *IndexEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if !bytes.Contains(scanner.Bytes(), quoted) {
+			continue
+		}
+		var entry IndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		if entry.Upload == uploadKey && entry.Kind != KindLeft {
+			found = &entry
+		}
+	}
+	return found, scanner.Err()
+}
+
+// Serialize returns what to write and the number of entries in it, or error
+func (i *Index) Serialize(contentType string) (io.Reader, int64, int, error) {
 	if contentType != "application/jsonlines" {
-		return nil, 0, fmt.Errorf("unsupported content-type %s", contentType)
+		return nil, 0, 0, fmt.Errorf("unsupported content-type %s", contentType)
 	}
 
 	// we could probably be clever and serialize on reader Read, but let's do that later
 	separator := []byte{'\n'}
 	buf := bytes.NewBuffer([]byte{})
+	i.mu.RLock()
+	defer i.mu.RUnlock()
 	for _, entry := range i.entries {
 		jsonline, err := json.Marshal(entry)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, 0, err
 		}
 		_, err = buf.Write(jsonline)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, 0, err
 		}
 		_, err = buf.Write(separator)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, 0, err
 		}
 	}
 
-	return buf, int64(buf.Len()), nil
+	return buf, int64(buf.Len()), len(i.entries), nil
 }
@@ -0,0 +1,559 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+)
+
+const (
+	commitIntervalDefault = time.Duration(time.Second * 1)
+	commitBatchDefault    = 100
+	// revokeWait bounds how long a rebalance waits for started work, well below the default session timeout
+	revokeWait = time.Duration(time.Second * 20)
+)
+
+// Offsets is what we commit, the offset of the next record to consume per topic and partition
+type Offsets map[string]map[int32]kgo.EpochOffset
+
+type KafkaAckPending struct {
+	info     *notification.Info
+	record   *kgo.Record
+	received time.Time
+	started  bool
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// partitionAcks is a watermark: we can commit up to the first offset that isn't acked
+type partitionAcks struct {
+	// offsets are those emitted but not yet committable, in fetch order
+	offsets []int64
+	// done has the leader epoch of acked offsets
+	done      map[int64]int32
+	next      kgo.EpochOffset
+	committed int64
+	// highWatermark is from the latest fetch, -1 until there's been one
+	highWatermark int64
+}
+
+// lag is the number of records on the partition that are not yet acked, -1 if unknown
+func (p *partitionAcks) lag() int64 {
+	if p.highWatermark < 0 {
+		return -1
+	}
+	from := p.next.Offset
+	if len(p.offsets) > 0 {
+		from = p.offsets[0]
+	}
+	if from < 0 {
+		return -1
+	}
+	return p.highWatermark - from
+}
+
+type KafkaAcks struct {
+	logger               *zap.Logger
+	mu                   sync.Mutex
+	pending              map[bucket.Delivery]*KafkaAckPending
+	partitions           map[topicPartition]*partitionAcks
+	revoking             map[topicPartition]bool
+	revokeWait           time.Duration
+	uncommitted          int
+	commitMu             sync.Mutex
+	commitOffsets        func(context.Context, Offsets) error
+	commitInterval       time.Duration
+	commitBatch          int
+	commitNow            chan struct{}
+	deadLetter           func(context.Context, *kgo.Record, string) error
+	metricPending        prometheus.Gauge
+	metricLag            *prometheus.GaugeVec
+	metricCommitFailures prometheus.Counter
+}
+
+func NewKafkaAckPending(info *notification.Info, record *kgo.Record) KafkaAckPending {
+	return KafkaAckPending{
+		info:     info,
+		record:   record,
+		received: time.Now(),
+	}
+}
+
+func NewKafkaAcks(logger *zap.Logger, metricPending prometheus.Gauge) *KafkaAcks {
+	logger.Info("(for performance logging) sample duration log entries",
+		zap.Duration("5ms", time.Duration(time.Millisecond*5)),
+		zap.Duration("3s2µs", time.Duration(time.Second*3+time.Microsecond*2)),
+	)
+	return &KafkaAcks{
+		logger:         logger,
+		pending:        make(map[bucket.Delivery]*KafkaAckPending),
+		partitions:     make(map[topicPartition]*partitionAcks),
+		revoking:       make(map[topicPartition]bool),
+		revokeWait:     revokeWait,
+		commitInterval: commitIntervalDefault,
+		commitBatch:    commitBatchDefault,
+		commitNow:      make(chan struct{}, 1),
+		metricPending:  metricPending,
+	}
+}
+
+// SetCommitPolicy sets how often, and after how many acks, the commit loop commits
+func (a *KafkaAcks) SetCommitPolicy(interval time.Duration, batch int) {
+	if interval > 0 {
+		a.commitInterval = interval
+	}
+	if batch > 0 {
+		a.commitBatch = batch
+	}
+}
+
+// SetMetrics enables per partition lag, with topic and partition labels, and counting of failed commits
+func (a *KafkaAcks) SetMetrics(lag *prometheus.GaugeVec, commitFailures prometheus.Counter) {
+	a.metricLag = lag
+	a.metricCommitFailures = commitFailures
+}
+
+func (a *KafkaAcks) SetClient(c *kgo.Client) {
+	a.SetClientCommit(func(ctx context.Context, offsets Offsets) error {
+		var commitErr error
+		c.CommitOffsetsSync(ctx, offsets, func(_ *kgo.Client, _ *kmsg.OffsetCommitRequest, resp *kmsg.OffsetCommitResponse, err error) {
+			if err != nil {
+				commitErr = err
+				return
+			}
+			for _, t := range resp.Topics {
+				for _, p := range t.Partitions {
+					if err := kerr.ErrorForCode(p.ErrorCode); err != nil {
+						commitErr = fmt.Errorf("%s/%d: %w", t.Topic, p.Partition, err)
+					}
+				}
+			}
+		})
+		return commitErr
+	})
+}
+
+// SetClientCommit sets a synchronous commit, which the commit loop calls in the background
+func (a *KafkaAcks) SetClientCommit(commit func(context.Context, Offsets) error) {
+	a.commitOffsets = commit
+}
+
+// SetDeadLetter enables acks for failed transfers, which otherwise are fatal
+func (a *KafkaAcks) SetDeadLetter(deadLetter func(ctx context.Context, record *kgo.Record, reason string) error) {
+	a.deadLetter = deadLetter
+}
+
+func (a *KafkaAcks) partition(record *kgo.Record) *partitionAcks {
+	tp := topicPartition{topic: record.Topic, partition: record.Partition}
+	p, found := a.partitions[tp]
+	if !found {
+		p = &partitionAcks{
+			done:          make(map[int64]int32),
+			next:          kgo.EpochOffset{Epoch: -1, Offset: -1},
+			committed:     -1,
+			highWatermark: -1,
+		}
+		a.partitions[tp] = p
+	}
+	return p
+}
+
+func (a *KafkaAcks) Expect(p KafkaAckPending) {
+	if p.info == nil {
+		a.logger.Fatal("Refusing to record pending with nil info")
+	}
+	if p.record == nil {
+		a.logger.Fatal("Refusing to record pending with nil record")
+	}
+	delivery := bucket.DeliveryOf(p.info)
+	if delivery == nil {
+		a.logger.Fatal("Refusing to record pending without records", zap.Any("record", p.record))
+	}
+	a.mu.Lock()
+	a.pending[delivery] = &p
+	partition := a.partition(p.record)
+	partition.offsets = append(partition.offsets, p.record.Offset)
+	a.mu.Unlock()
+	a.logger.Info("Recorded pending ack")
+	a.metricPending.Inc()
+}
+
+// lookup must be called with mu held, and returns nil if the notification isn't pending
+func (a *KafkaAcks) lookup(info *notification.Info) *KafkaAckPending {
+	return a.pending[bucket.DeliveryOf(info)]
+}
+
+// Fetched records the partition's high watermark, for lag
+func (a *KafkaAcks) Fetched(topic string, partition int32, highWatermark int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	tp := topicPartition{topic: topic, partition: partition}
+	p, found := a.partitions[tp]
+	if !found {
+		// a partition without records to track yet, at least we know what we haven't fetched
+		return
+	}
+	p.highWatermark = highWatermark
+	a.updateLag(tp, p)
+}
+
+// updateLag must be called with mu held
+func (a *KafkaAcks) updateLag(tp topicPartition, p *partitionAcks) {
+	if a.metricLag == nil {
+		return
+	}
+	lag := p.lag()
+	if lag < 0 {
+		return
+	}
+	a.metricLag.With(prometheus.Labels{"topic": tp.topic, "partition": strconv.FormatInt(int64(tp.partition), 10)}).Set(float64(lag))
+}
+
+// OldestPending is the time since the oldest pending notification was received, zero if none is pending
+func (a *KafkaAcks) OldestPending() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var oldest time.Time
+	for _, p := range a.pending {
+		if oldest.IsZero() || p.received.Before(oldest) {
+			oldest = p.received
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+// Begin marks a notification started, or returns false if its partition was revoked or is being revoked
+func (a *KafkaAcks) Begin(info *notification.Info) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p := a.lookup(info)
+	if p == nil {
+		a.logger.Info("Skipping notification from a revoked partition", zap.Any("info", info))
+		return false
+	}
+	if a.revoking[topicPartition{topic: p.record.Topic, partition: p.record.Partition}] {
+		a.logger.Info("Skipping notification from a partition being revoked",
+			zap.String("topic", p.record.Topic),
+			zap.Int32("partition", p.record.Partition),
+		)
+		return false
+	}
+	p.started = true
+	return true
+}
+
+// Abandon undoes Begin for a notification that won't be acked, so that a revoke doesn't wait for it.
+// It stays pending, so it isn't committed and the next consumer of the partition gets it.
+func (a *KafkaAcks) Abandon(info *notification.Info) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if p := a.lookup(info); p != nil {
+		p.started = false
+	}
+}
+
+// remove does lookup, then removes the matching item from pending, returning nil if not found
+func (a *KafkaAcks) remove(info *notification.Info) *KafkaAckPending {
+	p := a.lookup(info)
+	if p != nil {
+		delete(a.pending, bucket.DeliveryOf(info))
+	}
+	return p
+}
+
+// Ack marks the record done; it's committed in the background once all prior records on the partition are done
+func (a *KafkaAcks) Ack(ackctx context.Context, result bucket.TransferResult, info *notification.Info) {
+	if a.commitOffsets == nil {
+		a.logger.Fatal("Ack called prior to kafka client initialization")
+	}
+	a.mu.Lock()
+	pending := a.remove(info)
+	if pending == nil {
+		a.mu.Unlock()
+		// could be a partition that was revoked while the notification was processed
+		a.logger.Warn("Ack for a record that isn't pending, ignoring", zap.Any("info", info))
+		return
+	}
+	record := pending.record
+	a.mu.Unlock()
+	if result != bucket.TransferOk {
+		if a.deadLetter == nil {
+			a.logger.Fatal("Ack for failed transfers requires a dead letter topic", zap.Any("info", info), zap.Any("record", record))
+		}
+		if err := a.deadLetter(ackctx, record, "transfer failed after retries"); err != nil {
+			a.logger.Fatal("Failed to produce to dead letter topic", zap.Any("record", record), zap.Error(err))
+		}
+	}
+	a.done(record)
+}
+
+// Forget undoes Expect for a record that wasn't emitted after all, for example at shutdown,
+// so that it neither holds back the watermark nor gets committed
+func (a *KafkaAcks) Forget(record *kgo.Record) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	found := false
+	for delivery, p := range a.pending {
+		if p.record == record {
+			delete(a.pending, delivery)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return
+	}
+	partition := a.partition(record)
+	for i, offset := range partition.offsets {
+		if offset == record.Offset {
+			partition.offsets = append(partition.offsets[:i], partition.offsets[i+1:]...)
+			break
+		}
+	}
+	a.metricPending.Dec()
+}
+
+// Skip is for records that weren't emitted, for example after dead lettering, to not hold back the watermark
+func (a *KafkaAcks) Skip(record *kgo.Record) {
+	a.mu.Lock()
+	partition := a.partition(record)
+	partition.offsets = append(partition.offsets, record.Offset)
+	a.mu.Unlock()
+	a.metricPending.Inc()
+	a.done(record)
+}
+
+func (a *KafkaAcks) done(record *kgo.Record) {
+	a.mu.Lock()
+	partition := a.partition(record)
+	partition.done[record.Offset] = record.LeaderEpoch
+	for len(partition.offsets) > 0 {
+		epoch, done := partition.done[partition.offsets[0]]
+		if !done {
+			break
+		}
+		delete(partition.done, partition.offsets[0])
+		partition.next = kgo.EpochOffset{Epoch: epoch, Offset: partition.offsets[0] + 1}
+		partition.offsets = partition.offsets[1:]
+	}
+	watermark := partition.next.Offset
+	a.updateLag(topicPartition{topic: record.Topic, partition: record.Partition}, partition)
+	a.uncommitted++
+	batchReady := a.uncommitted >= a.commitBatch
+	a.mu.Unlock()
+	a.metricPending.Dec()
+	a.logger.Debug("Acked",
+		zap.String("topic", record.Topic),
+		zap.Int32("partition", record.Partition),
+		zap.Int64("offset", record.Offset),
+		zap.Int64("watermark", watermark),
+	)
+	if batchReady {
+		select {
+		case a.commitNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// committable returns offsets that have advanced since the last commit, for the given partitions or all if nil
+func (a *KafkaAcks) committable(only map[string][]int32) Offsets {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	offsets := make(Offsets)
+	for tp, p := range a.partitions {
+		if only != nil && !contains(only[tp.topic], tp.partition) {
+			continue
+		}
+		if p.next.Offset <= p.committed {
+			continue
+		}
+		if offsets[tp.topic] == nil {
+			offsets[tp.topic] = make(map[int32]kgo.EpochOffset)
+		}
+		offsets[tp.topic][tp.partition] = p.next
+	}
+	a.uncommitted = 0
+	return offsets
+}
+
+func contains(partitions []int32, partition int32) bool {
+	for _, p := range partitions {
+		if p == partition {
+			return true
+		}
+	}
+	return false
+}
+
+// commit is serialized so that a final commit can't be overtaken by an earlier one
+func (a *KafkaAcks) commit(ctx context.Context, only map[string][]int32) error {
+	a.commitMu.Lock()
+	defer a.commitMu.Unlock()
+	offsets := a.committable(only)
+	if len(offsets) == 0 {
+		return nil
+	}
+	tcommitstart := time.Now()
+	if err := a.commitOffsets(ctx, offsets); err != nil {
+		if a.metricCommitFailures != nil {
+			a.metricCommitFailures.Inc()
+		}
+		return err
+	}
+	a.mu.Lock()
+	for topic, partitions := range offsets {
+		for partition, offset := range partitions {
+			if p, found := a.partitions[topicPartition{topic: topic, partition: partition}]; found {
+				p.committed = offset.Offset
+			}
+		}
+	}
+	a.mu.Unlock()
+	a.logger.Info("Commit",
+		zap.Any("offsets", offsets),
+		zap.Duration("duration", time.Since(tcommitstart)),
+	)
+	return nil
+}
+
+// Run commits in the background until ctx is done, on interval or when a batch of acks is reached
+func (a *KafkaAcks) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.commitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-a.commitNow:
+		}
+		if err := a.commit(ctx, nil); err != nil && ctx.Err() == nil {
+			// we'll retry on next tick, and worst case records are redelivered
+			a.logger.Error("Offset commit failed", zap.Error(err))
+		}
+	}
+}
+
+// Flush commits synchronously, for shutdown
+func (a *KafkaAcks) Flush(ctx context.Context) error {
+	return a.commit(ctx, nil)
+}
+
+// Revoked commits the revoked partitions synchronously then forgets them, including their pending acks
+func (a *KafkaAcks) Revoked(ctx context.Context, revoked map[string][]int32) {
+	a.mu.Lock()
+	for topic, partitions := range revoked {
+		for _, partition := range partitions {
+			a.revoking[topicPartition{topic: topic, partition: partition}] = true
+		}
+	}
+	a.mu.Unlock()
+	a.awaitStarted(ctx, revoked)
+	if err := a.commit(ctx, revoked); err != nil {
+		a.logger.Error("Final offset commit for revoked partitions failed", zap.Any("revoked", revoked), zap.Error(err))
+	}
+	a.forget(revoked)
+}
+
+// Lost forgets partitions without a commit, because we're no longer in the group
+func (a *KafkaAcks) Lost(lost map[string][]int32) {
+	a.logger.Warn("Partitions lost", zap.Any("lost", lost))
+	a.forget(lost)
+}
+
+// awaitStarted lets transfers that have begun on revoked partitions finish, so their acks can be committed
+func (a *KafkaAcks) awaitStarted(ctx context.Context, revoked map[string][]int32) {
+	ctx, cancel := context.WithTimeout(ctx, a.revokeWait)
+	defer cancel()
+	poll := time.NewTicker(time.Millisecond * 50)
+	defer poll.Stop()
+	for {
+		started := a.startedIn(revoked)
+		if started == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			a.logger.Warn("Revoking partitions with unfinished transfers", zap.Any("revoked", revoked), zap.Int("started", started))
+			return
+		case <-poll.C:
+		}
+	}
+}
+
+func (a *KafkaAcks) startedIn(partitions map[string][]int32) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	started := 0
+	for _, p := range a.pending {
+		if p.started && contains(partitions[p.record.Topic], p.record.Partition) {
+			started++
+		}
+	}
+	return started
+}
+
+func (a *KafkaAcks) forget(revoked map[string][]int32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	dropped := 0
+	for delivery, p := range a.pending {
+		if contains(revoked[p.record.Topic], p.record.Partition) {
+			delete(a.pending, delivery)
+			dropped++
+		}
+	}
+	for topic, partitions := range revoked {
+		for _, partition := range partitions {
+			delete(a.partitions, topicPartition{topic: topic, partition: partition})
+			delete(a.revoking, topicPartition{topic: topic, partition: partition})
+			if a.metricLag != nil {
+				a.metricLag.Delete(prometheus.Labels{"topic": topic, "partition": strconv.FormatInt(int64(partition), 10)})
+			}
+		}
+	}
+	a.metricPending.Sub(float64(dropped))
+	a.logger.Info("Partitions forgotten", zap.Any("partitions", revoked), zap.Int("droppedPending", dropped))
+}
+
+func (a *KafkaAcks) PendingSize() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.pending)
+}
+
+func (a *KafkaAcks) Pending() []bucket.PendingAck {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pending := make([]bucket.PendingAck, 0, len(a.pending))
+	for _, p := range a.pending {
+		keys := make([]string, 0, len(p.info.Records))
+		for _, r := range p.info.Records {
+			keys = append(keys, r.S3.Object.Key)
+		}
+		pending = append(pending, bucket.PendingAck{
+			Source:   fmt.Sprintf("%s/%d@%d", p.record.Topic, p.record.Partition, p.record.Offset),
+			Keys:     keys,
+			Received: p.received,
+		})
+	}
+	bucket.SortPending(pending)
+	return pending
+}
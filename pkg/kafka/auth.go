@@ -0,0 +1,191 @@
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/oauth"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+const (
+	SaslPlain        = "PLAIN"
+	SaslScramSha256  = "SCRAM-SHA-256"
+	SaslScramSha512  = "SCRAM-SHA-512"
+	SaslOauthBearer  = "OAUTHBEARER"
+	authConfigEnvVar = "KAFKA_AUTH_CONFIG"
+)
+
+// KafkaAuthConfig is shared by consumer and producer clients, the zero value means plaintext without SASL
+type KafkaAuthConfig struct {
+	// SaslMechanism is one of PLAIN, SCRAM-SHA-256, SCRAM-SHA-512, OAUTHBEARER, or empty
+	SaslMechanism string `json:"saslMechanism,omitempty"`
+	SaslUsername  string `json:"saslUsername,omitempty"`
+	SaslPassword  string `json:"saslPassword,omitempty"`
+	// OauthToken is a static token, OauthTokenFile is re-read for every new connection to support rotation
+	OauthToken     string `json:"oauthToken,omitempty"`
+	OauthTokenFile string `json:"oauthTokenFile,omitempty"`
+	// Tls is implied by any of the other TLS settings
+	Tls                   bool   `json:"tls,omitempty"`
+	TlsCaFile             string `json:"tlsCaFile,omitempty"`
+	TlsCertFile           string `json:"tlsCertFile,omitempty"`
+	TlsKeyFile            string `json:"tlsKeyFile,omitempty"`
+	TlsServerName         string `json:"tlsServerName,omitempty"`
+	TlsInsecureSkipVerify bool   `json:"tlsInsecureSkipVerify,omitempty"`
+}
+
+// LoadKafkaAuth reads the JSON file named by KAFKA_AUTH_CONFIG if set, then applies KAFKA_SASL_* and KAFKA_TLS_* env on top
+func LoadKafkaAuth(getenv func(string) string) (*KafkaAuthConfig, error) {
+	config := &KafkaAuthConfig{}
+	if file := getenv(authConfigEnvVar); file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", authConfigEnvVar, err)
+		}
+		if err := json.Unmarshal(b, config); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", authConfigEnvVar, file, err)
+		}
+	}
+	strs := map[string]*string{
+		"KAFKA_SASL_MECHANISM":        &config.SaslMechanism,
+		"KAFKA_SASL_USERNAME":         &config.SaslUsername,
+		"KAFKA_SASL_PASSWORD":         &config.SaslPassword,
+		"KAFKA_SASL_OAUTH_TOKEN":      &config.OauthToken,
+		"KAFKA_SASL_OAUTH_TOKEN_FILE": &config.OauthTokenFile,
+		"KAFKA_TLS_CA_FILE":           &config.TlsCaFile,
+		"KAFKA_TLS_CERT_FILE":         &config.TlsCertFile,
+		"KAFKA_TLS_KEY_FILE":          &config.TlsKeyFile,
+		"KAFKA_TLS_SERVER_NAME":       &config.TlsServerName,
+	}
+	for name, value := range strs {
+		if v := getenv(name); v != "" {
+			*value = v
+		}
+	}
+	bools := map[string]*bool{
+		"KAFKA_TLS":                      &config.Tls,
+		"KAFKA_TLS_INSECURE_SKIP_VERIFY": &config.TlsInsecureSkipVerify,
+	}
+	for name, value := range bools {
+		if v := getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			*value = b
+		}
+	}
+	return config, nil
+}
+
+// Opts validates the config and returns the client options it needs
+func (a *KafkaAuthConfig) Opts() ([]kgo.Opt, error) {
+	var opts []kgo.Opt
+	if a == nil {
+		return opts, nil
+	}
+	mechanism, err := a.mechanism()
+	if err != nil {
+		return nil, err
+	}
+	if mechanism != nil {
+		opts = append(opts, kgo.SASL(mechanism))
+	}
+	tlsConfig, err := a.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts = append(opts, kgo.DialTLSConfig(tlsConfig))
+	}
+	return opts, nil
+}
+
+func (a *KafkaAuthConfig) mechanism() (sasl.Mechanism, error) {
+	switch strings.ToUpper(a.SaslMechanism) {
+	case "":
+		return nil, nil
+	case SaslPlain:
+		if a.SaslUsername == "" {
+			return nil, fmt.Errorf("SASL %s requires a username", SaslPlain)
+		}
+		return plain.Auth{User: a.SaslUsername, Pass: a.SaslPassword}.AsMechanism(), nil
+	case SaslScramSha256:
+		if a.SaslUsername == "" {
+			return nil, fmt.Errorf("SASL %s requires a username", SaslScramSha256)
+		}
+		return scram.Auth{User: a.SaslUsername, Pass: a.SaslPassword}.AsSha256Mechanism(), nil
+	case SaslScramSha512:
+		if a.SaslUsername == "" {
+			return nil, fmt.Errorf("SASL %s requires a username", SaslScramSha512)
+		}
+		return scram.Auth{User: a.SaslUsername, Pass: a.SaslPassword}.AsSha512Mechanism(), nil
+	case SaslOauthBearer:
+		if a.OauthToken != "" {
+			return oauth.Auth{Token: a.OauthToken}.AsMechanism(), nil
+		}
+		if a.OauthTokenFile == "" {
+			return nil, fmt.Errorf("SASL %s requires a token or token file", SaslOauthBearer)
+		}
+		file := a.OauthTokenFile
+		return oauth.Oauth(func(context.Context) (oauth.Auth, error) {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				return oauth.Auth{}, err
+			}
+			return oauth.Auth{Token: strings.TrimSpace(string(b))}, nil
+		}), nil
+	}
+	return nil, fmt.Errorf("unsupported SASL mechanism %q", a.SaslMechanism)
+}
+
+func (a *KafkaAuthConfig) tlsConfig() (*tls.Config, error) {
+	if !a.Tls && a.TlsCaFile == "" && a.TlsCertFile == "" && a.TlsKeyFile == "" &&
+		a.TlsServerName == "" && !a.TlsInsecureSkipVerify {
+		return nil, nil
+	}
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         a.TlsServerName,
+		InsecureSkipVerify: a.TlsInsecureSkipVerify,
+	}
+	if a.TlsCaFile != "" {
+		pem, err := os.ReadFile(a.TlsCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("TLS CA: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS CA %s contains no certificates", a.TlsCaFile)
+		}
+	}
+	if (a.TlsCertFile == "") != (a.TlsKeyFile == "") {
+		return nil, fmt.Errorf("TLS client certificate requires both cert and key files")
+	}
+	if a.TlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(a.TlsCertFile, a.TlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("TLS client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// String is safe for logging
+func (a *KafkaAuthConfig) String() string {
+	if a == nil {
+		return "none"
+	}
+	tlsEnabled, _ := a.tlsConfig()
+	return fmt.Sprintf("sasl=%q tls=%t clientcert=%t", strings.ToUpper(a.SaslMechanism), tlsEnabled != nil, a.TlsCertFile != "")
+}
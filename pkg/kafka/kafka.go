@@ -1,15 +1,15 @@
 package kafka
 
 import (
-	"bytes"
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	jsoniter "github.com/json-iterator/go"
 	"github.com/minio/minio-go/v7/pkg/notification"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/twmb/franz-go/pkg/kgo"
 	"github.com/twmb/franz-go/plugin/kzap"
 	"go.uber.org/zap"
@@ -27,37 +27,39 @@ type KafkaConsumerConfig struct {
 	ConsumerGroup string
 	FetchMaxWait  time.Duration
 	Filter        MessageFilter
+	// Auth is SASL and TLS, nil for plaintext
+	Auth *KafkaAuthConfig
+	// DeadLetterTopic gets unprocessable records and those that failed transfer, fatal if empty
+	DeadLetterTopic string
+	// CommitInterval and CommitBatch trigger background offset commits, zero for defaults
+	CommitInterval time.Duration
+	CommitBatch    int
 }
 
-type KafkaAckPending struct {
-	info   *notification.Info
-	record *kgo.Record
-}
-
-type KafkaAcks struct {
-	logger        *zap.Logger
-	pending       []KafkaAckPending
-	commitRecords func(context.Context, ...*kgo.Record) error
-	metricPending prometheus.Gauge
+func NewFilterPredicate(config MessageFilter, logger *zap.Logger) func(record *kgo.Record) bool {
+	keyFilter := NewKeyFilterPredicate(config, logger)
+	return func(record *kgo.Record) bool {
+		return keyFilter(string(record.Key))
+	}
 }
 
-func NewFilterPredicate(config MessageFilter, logger *zap.Logger) func(record *kgo.Record) bool {
+// NewKeyFilterPredicate is the filter for sources that have the MinIO event key in the payload rather than a record key
+func NewKeyFilterPredicate(config MessageFilter, logger *zap.Logger) func(key string) bool {
 	if config.KeyPrefix == "" {
-		return func(record *kgo.Record) bool {
+		return func(key string) bool {
 			return true
 		}
 	}
-	prefix := []byte(config.KeyPrefix)
-	ignoredFiltered := promauto.NewCounter(prometheus.CounterOpts{
+	ignoredFiltered := bucket.Registered(prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "blobs_ignored_filtered",
 		Help: "The number of notifications ignored the notification did not match the filter",
 		ConstLabels: prometheus.Labels{
-			"prefix": string(prefix),
+			"prefix": config.KeyPrefix,
 		},
-	})
-	logger.Info("Message filter enabled on key", zap.ByteString("prefix", prefix))
-	return func(record *kgo.Record) bool {
-		hit := bytes.HasPrefix(record.Key, prefix)
+	}))
+	logger.Info("Message filter enabled on key", zap.String("prefix", config.KeyPrefix))
+	return func(key string) bool {
+		hit := strings.HasPrefix(key, config.KeyPrefix)
 		if !hit {
 			ignoredFiltered.Inc()
 		}
@@ -65,190 +67,204 @@ func NewFilterPredicate(config MessageFilter, logger *zap.Logger) func(record *k
 	}
 }
 
-func NewKafkaAckPending(info *notification.Info, record *kgo.Record) KafkaAckPending {
-	return KafkaAckPending{
-		info:   info,
-		record: record,
-	}
-}
-
-func NewKafkaAcks(logger *zap.Logger, metricPending prometheus.Gauge) *KafkaAcks {
-	logger.Info("(for performance logging) sample duration log entries",
-		zap.Duration("5ms", time.Duration(time.Millisecond*5)),
-		zap.Duration("3s2µs", time.Duration(time.Second*3+time.Microsecond*2)),
+// NewDeadLetterRecord keeps the original key, value and headers, and adds headers describing the failure
+func NewDeadLetterRecord(topic string, record *kgo.Record, reason string) *kgo.Record {
+	headers := make([]kgo.RecordHeader, len(record.Headers), len(record.Headers)+4)
+	copy(headers, record.Headers)
+	headers = append(headers,
+		kgo.RecordHeader{Key: "dlt-error", Value: []byte(reason)},
+		kgo.RecordHeader{Key: "dlt-topic", Value: []byte(record.Topic)},
+		kgo.RecordHeader{Key: "dlt-partition", Value: []byte(strconv.FormatInt(int64(record.Partition), 10))},
+		kgo.RecordHeader{Key: "dlt-offset", Value: []byte(strconv.FormatInt(record.Offset, 10))},
 	)
-	return &KafkaAcks{
-		logger:        logger,
-		metricPending: metricPending,
+	return &kgo.Record{
+		Topic:   topic,
+		Key:     record.Key,
+		Value:   record.Value,
+		Headers: headers,
 	}
 }
 
-func (a *KafkaAcks) SetClient(c *kgo.Client) {
-	// TODO async CommitOffsets would probably be preferrable, and would likely reduce delays in tests
-	a.SetClientCommit(c.CommitRecords)
+// newClientOpts is the client setup shared by consumers and producers
+func newClientOpts(logger *zap.Logger, bootstrap []string, auth *KafkaAuthConfig) []kgo.Opt {
+	authOpts, err := auth.Opts()
+	if err != nil {
+		logger.Fatal("Kafka auth config failure", zap.Error(err))
+	}
+	logger.Info("Kafka auth", zap.Stringer("config", auth))
+	return append([]kgo.Opt{
+		kgo.WithLogger(kzap.New(logger)),
+		kgo.SeedBrokers(bootstrap...),
+	}, authOpts...)
 }
 
-func (a *KafkaAcks) SetClientCommit(commit func(context.Context, ...*kgo.Record) error) {
-	a.commitRecords = commit
-}
+// NewKafka consumes until ctx is cancelled, while acks and Close use their own contexts to allow a drain
+func NewKafka(ctx context.Context, config *KafkaConsumerConfig) *bucket.InboxWatcher {
 
-func (a *KafkaAcks) Expect(p KafkaAckPending) {
-	if p.info == nil {
-		a.logger.Fatal("Refusing to record pending with nil info")
-	}
-	if p.record == nil {
-		a.logger.Fatal("Refusing to record pending with nil record")
-	}
-	// a.uniqueId(p.Info) // verify compatibility, currently unsupported for unit tests
-	a.pending = append(a.pending, p)
-	a.logger.Info("Recorded pending ack")
-	a.metricPending.Inc()
-}
+	logger := config.Logger
 
-// uniqueId trusts https://github.com/minio/minio/blob/RELEASE.2023-01-06T18-11-18Z/cmd/event-notification.go#L289
-func (a *KafkaAcks) uniqueId(info *notification.Info) string {
-	if len(info.Records) != 1 {
-		a.logger.Fatal("Unsupported records", zap.Int("len", len(info.Records)), zap.Any("info", info))
-	}
-	u := info.Records[0].S3.Object.Sequencer
-	if u == "" {
-		a.logger.Fatal("Missing record uniqueness value", zap.Any("info", info))
-	}
-	return info.Records[0].S3.Object.Sequencer
-}
+	filter := NewFilterPredicate(config.Filter, logger)
 
-func (a *KafkaAcks) lookup(info *notification.Info) (int, KafkaAckPending) {
-	if len(a.pending) == 0 {
-		a.logger.Fatal("Ack requested but there are no pending records")
-	}
-	for i, p := range a.pending {
-		if p.info == info { // used by unit test
-			return i, p
-		}
-		if a.uniqueId(p.info) == a.uniqueId(info) {
-			return i, p
-		}
-		a.logger.Warn("Fifo order pending lookup failed",
-			zap.Any(fmt.Sprintf("index%d", i), p.info),
-			zap.String("infoptr", fmt.Sprintf("%p", p.info)),
-		)
-	}
-	a.logger.Fatal("Failed to find unacked record",
-		zap.Any("expected", info),
-		zap.String("ptr", fmt.Sprintf("%p", info)),
+	acks := NewKafkaAcks(logger, bucket.Registered(prometheus.NewGauge(bucket.PendingGaugeOpts)))
+	acks.SetCommitPolicy(config.CommitInterval, config.CommitBatch)
+	acks.SetMetrics(
+		bucket.Registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "blobs_watch_consumer_lag",
+			Help: "Records on the partition, up to the latest fetched high watermark, that are not yet acked",
+		}, []string{"topic", "partition"})),
+		bucket.Registered(prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "blobs_watch_commit_failures",
+			Help: "Offset commits that failed, to be retried on the next commit",
+		})),
 	)
-	return -1, KafkaAckPending{} // after fatal
-}
+	oldest := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "blobs_watch_acks_oldest_seconds",
+		Help: "Age of the oldest notification emitted but not yet acked, zero if none",
+	}, func() float64 {
+		return acks.OldestPending().Seconds()
+	})
+	// replaces any previous run's, which would read that run's acks
+	prometheus.Unregister(oldest)
+	prometheus.MustRegister(oldest)
+	rebalances := bucket.Registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blobs_watch_rebalances",
+		Help: "Consumer group partition changes, by event assigned, revoked or lost",
+	}, []string{"event"}))
 
-// remove does lookup, then removes the matching item from pending
-func (a *KafkaAcks) remove(info *notification.Info) KafkaAckPending {
-	i, p := a.lookup(info)
-	a.pending = append(a.pending[:i], a.pending[i+1:]...)
-	return p
-}
+	// https://github.com/minio/minio-go/blob/v7.0.46/api-bucket-notification.go#L209
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
 
-func (a *KafkaAcks) Ack(ackctx context.Context, result bucket.TransferResult, info *notification.Info) {
-	if a.commitRecords == nil {
-		a.logger.Fatal("Ack called prior to kafka client initialization")
-	}
-	pending := a.remove(info)
-	record := pending.record
-	if result != bucket.TransferOk {
-		a.logger.Fatal("Ack for failed transfers not implemented", zap.Any("info", info), zap.Any("record", record))
-	}
-	tcommitstart := time.Now()
-	if err := a.commitRecords(ackctx, record); err != nil {
-		a.logger.Fatal("Offset commit failed",
-			zap.String("topic", record.Topic),
-			zap.Int32("partition", record.Partition),
-			zap.Int64("offset", record.Offset),
-			zap.ByteString("key", record.Key),
+	var contact bucket.Contact
+
+	cl, err := kgo.NewClient(
+		append(newClientOpts(logger, config.Bootstrap, config.Auth),
+			kgo.ConsumerGroup(config.ConsumerGroup),
+			kgo.ConsumeTopics(config.Topics...),
+			kgo.FetchMaxWait(config.FetchMaxWait),
+			// offsets are committed after ack, i.e. after transfer and any transfer event produce
+			kgo.DisableAutoCommit(),
+			kgo.OnPartitionsAssigned(func(_ context.Context, _ *kgo.Client, assigned map[string][]int32) {
+				rebalances.With(prometheus.Labels{"event": "assigned"}).Inc()
+				logger.Info("Partitions assigned", zap.Any("assigned", assigned))
+			}),
+			kgo.OnPartitionsRevoked(func(revokectx context.Context, _ *kgo.Client, revoked map[string][]int32) {
+				rebalances.With(prometheus.Labels{"event": "revoked"}).Inc()
+				acks.Revoked(revokectx, revoked)
+			}),
+			kgo.OnPartitionsLost(func(_ context.Context, _ *kgo.Client, lost map[string][]int32) {
+				rebalances.With(prometheus.Labels{"event": "lost"}).Inc()
+				acks.Lost(lost)
+			}),
+		)...,
+	)
+	if err != nil {
+		logger.Fatal("Kafka client failure",
+			zap.Strings("bootstrap", config.Bootstrap),
+			zap.Strings("topics", config.Topics),
+			zap.String("group", config.ConsumerGroup),
 			zap.Error(err),
 		)
-	} else {
-		tcommit := time.Since(tcommitstart)
-		a.logger.Info("Commit",
+	}
+
+	deadLettered := bucket.Registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blobs_watch_dead_lettered",
+		Help: "Records produced to the dead letter topic, by reason",
+	}, []string{"reason"}))
+	deadLetter := func(dltctx context.Context, record *kgo.Record, reason string) error {
+		if err := cl.ProduceSync(dltctx, NewDeadLetterRecord(config.DeadLetterTopic, record, reason)).FirstErr(); err != nil {
+			return err
+		}
+		logger.Warn("Dead lettered",
 			zap.String("topic", record.Topic),
 			zap.Int32("partition", record.Partition),
 			zap.Int64("offset", record.Offset),
-			zap.Duration("duration", tcommit),
+			zap.String("reason", reason),
 		)
+		return nil
+	}
+	if config.DeadLetterTopic != "" {
+		logger.Info("Dead letter topic enabled", zap.String("topic", config.DeadLetterTopic))
+		acks.SetDeadLetter(func(dltctx context.Context, record *kgo.Record, reason string) error {
+			deadLettered.With(prometheus.Labels{"reason": "transfer"}).Inc()
+			return deadLetter(dltctx, record, reason)
+		})
 	}
-	a.metricPending.Dec()
-}
-
-func (a *KafkaAcks) PendingSize() int {
-	return len(a.pending)
-}
-
-func NewKafka(ctx context.Context, config *KafkaConsumerConfig) *bucket.InboxWatcher {
-
-	logger := config.Logger
-
-	filter := NewFilterPredicate(config.Filter, logger)
-
-	acks := NewKafkaAcks(logger, promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "blobs_watch_acks_pending",
-		Help: "Notifications emitted but not yet acked for on the consumer",
-	}))
 
-	// https://github.com/minio/minio-go/blob/v7.0.46/api-bucket-notification.go#L209
-	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	// Watermark commits per https://github.com/twmb/franz-go/blob/v1.11.0/docs/producing-and-consuming.md#offset-management
+	acks.SetClient(cl)
+	commitctx, stopCommits := context.WithCancel(context.Background())
+	go acks.Run(commitctx)
 
 	ch := make(chan notification.Info)
 	result := &bucket.InboxWatcher{
-		Uploads: ch,
-		Ack:     acks.Ack,
+		Uploads:  ch,
+		Ack:      acks.Ack,
+		Pending:  acks.Pending,
+		Begin:    acks.Begin,
+		Abandon:  acks.Abandon,
+		LastSeen: contact.LastSeen,
+		Close: func(closectx context.Context) {
+			stopCommits()
+			if err := acks.Flush(closectx); err != nil {
+				logger.Error("Final offset commit failed", zap.Error(err))
+			}
+			logger.Info("Closing kafka client", zap.Int("pending", acks.PendingSize()))
+			cl.Close()
+		},
 	}
 
-	go func(notificationInfoCh chan<- notification.Info) {
-		cl, err := kgo.NewClient(
-			kgo.WithLogger(kzap.New(logger)),
-			kgo.SeedBrokers(config.Bootstrap...),
-			kgo.ConsumerGroup(config.ConsumerGroup),
-			kgo.ConsumeTopics(config.Topics...),
-			kgo.FetchMaxWait(config.FetchMaxWait),
-		)
-		if err != nil {
-			logger.Fatal("Kafka client failure",
-				zap.Strings("bootstrap", config.Bootstrap),
-				zap.Strings("topics", config.Topics),
-				zap.String("group", config.ConsumerGroup),
-				zap.Error(err),
-			)
+	// pings brokers while there are no records
+	go contact.Heartbeat(ctx, func() bool {
+		if err := cl.Ping(ctx); err != nil {
+			logger.Warn("Kafka ping failed", zap.Error(err))
+			return false
 		}
-		defer cl.Close()
-		defer close(notificationInfoCh)
+		return true
+	})
 
-		// We're naive w.r.t https://github.com/twmb/franz-go/blob/v1.11.0/docs/producing-and-consuming.md#offset-management
-		acks.SetClient(cl)
+	go func(notificationInfoCh chan<- notification.Info) {
+		defer close(notificationInfoCh)
 
 		for {
 			fetches := cl.PollFetches(ctx)
+			if ctx.Err() != nil {
+				logger.Info("Kafka consumer stopped", zap.Error(ctx.Err()))
+				return
+			}
 			if errs := fetches.Errors(); len(errs) > 0 {
 				logger.Fatal("Non-retryable consumer error",
 					zap.String("errors", fmt.Sprint(errs)),
 				)
 			}
+			contact.Seen()
 
 			fetches.EachPartition(func(p kgo.FetchTopicPartition) {
 				p.EachRecord(func(record *kgo.Record) {
+					if ctx.Err() != nil {
+						return
+					}
 					if !filter(record) {
 						logger.Debug("Filtered out",
 							zap.String("topic", record.Topic),
 							zap.Int32("partition", record.Partition),
 							zap.ByteString("key", record.Key),
 							zap.Time("timestamp", record.Timestamp),
-							zap.Error(err),
 						)
 						return
 					}
 					var notificationInfo notification.Info
 					notificationInfoPtr := &notificationInfo
 					err := json.Unmarshal(record.Value, notificationInfoPtr)
+					if err != nil && config.DeadLetterTopic != "" {
+						if err := deadLetter(ctx, record, fmt.Sprintf("unmarshal: %s", err)); err != nil {
+							logger.Fatal("Failed to produce to dead letter topic", zap.Error(err))
+						}
+						deadLettered.With(prometheus.Labels{"reason": "unmarshal"}).Inc()
+						acks.Skip(record)
+						return
+					}
 					if err != nil {
-						// We'd need to export a counter here if we want to skip over unrecognized events
-						// Instead we crashloop and an admin must set a new consumer group offset
+						// Without a dead letter topic we crashloop and an admin must set a new consumer group offset
 						logger.Fatal("Failed to unmarshal notification",
 							zap.String("topic", record.Topic),
 							zap.Int32("partition", record.Partition),
@@ -268,6 +284,15 @@ func NewKafka(ctx context.Context, config *KafkaConsumerConfig) *bucket.InboxWat
 							zap.ByteString("value", record.Value),
 							zap.Time("timestamp", record.Timestamp),
 						)
+						if config.DeadLetterTopic != "" {
+							if err := deadLetter(ctx, record, "zero records"); err != nil {
+								logger.Fatal("Failed to produce to dead letter topic", zap.Error(err))
+							}
+							deadLettered.With(prometheus.Labels{"reason": "empty"}).Inc()
+						}
+						// there's nothing to transfer, and no ack would come
+						acks.Skip(record)
+						return
 					}
 					logger.Info("Got notification",
 						zap.String("topic", record.Topic),
@@ -277,8 +302,14 @@ func NewKafka(ctx context.Context, config *KafkaConsumerConfig) *bucket.InboxWat
 						zap.Time("timestamp", record.Timestamp),
 					)
 					acks.Expect(NewKafkaAckPending(&notificationInfo, record))
-					notificationInfoCh <- notificationInfo
+					select {
+					case notificationInfoCh <- notificationInfo:
+					case <-ctx.Done():
+						// never emitted so never acked, will be redelivered after restart
+						acks.Forget(record)
+					}
 				})
+				acks.Fetched(p.Topic, p.Partition, p.HighWatermark)
 			})
 		}
 	}(ch)
@@ -2,10 +2,16 @@ package kafka_test
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/minio/minio-go/v7/pkg/notification"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/twmb/franz-go/pkg/kgo"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
@@ -43,6 +49,16 @@ func TestFilter(t *testing.T) {
 		t.Error("Filter should return false with leading whitespace")
 	}
 
+	key := kafka.NewKeyFilterPredicate(kafka.MessageFilter{
+		KeyPrefix: "other-bucket/",
+	}, logger)
+	if !key("other-bucket/filename.txt") {
+		t.Error("Key filter should return true for configured prefix")
+	}
+	if key("bucket-name/filename.txt") {
+		t.Error("Key filter should return false for not prefix")
+	}
+
 }
 
 func TestAcks(t *testing.T) {
@@ -56,54 +72,540 @@ func TestAcks(t *testing.T) {
 
 	// many states use zap logger.Fatal so ATM we can only test the happy path
 
-	var commits []*kgo.Record
+	var commits []kafka.Offsets
 
-	acks.SetClientCommit(func(ctx context.Context, r ...*kgo.Record) error {
-		if len(r) != 1 {
-			t.Errorf("Unexpected records batch length %d", len(r))
-		}
-		commits = append(commits, r...)
+	acks.SetClientCommit(func(ctx context.Context, offsets kafka.Offsets) error {
+		commits = append(commits, offsets)
 		return nil
 	})
 
-	newInfo := func() notification.Info {
-		// todo support same uniqueness check as for info at runtime (that went through channel)
-		return notification.Info{}
+	newInfo := func(sequencer string) notification.Info {
+		info := notification.Info{Records: make([]notification.Event, 1)}
+		info.Records[0].S3.Object.Sequencer = sequencer
+		return info
 	}
 
-	info1 := newInfo()
+	info1 := newInfo("s1")
 	info1ptr1 := &info1
 	info1ptr2 := &info1
-	record1 := kgo.Record{}
+	record1 := kgo.Record{Topic: "t", Partition: 0, Offset: 10}
 	record1ptr1 := &record1
 	p1 := kafka.NewKafkaAckPending(info1ptr1, record1ptr1)
 	acks.Expect(p1)
 
-	info2 := newInfo()
-	record2 := kgo.Record{}
+	info2 := newInfo("s2")
+	record2 := kgo.Record{Topic: "t", Partition: 0, Offset: 11}
 	p2 := kafka.NewKafkaAckPending(&info2, &record2)
 	acks.Expect(p2)
 
 	if acks.PendingSize() != 2 {
 		t.Errorf("Expected 2 pending, got %d", acks.PendingSize())
 	}
+	if len(acks.Pending()) != 2 {
+		t.Errorf("Expected 2 pending descriptions, got %d", len(acks.Pending()))
+	}
 
-	acks.Ack(ctx, bucket.TransferOk, info1ptr2)
+	// a copy, like the one that went through the channel
+	info2copy := info2
+	acks.Ack(ctx, bucket.TransferOk, &info2copy)
+	if err := acks.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
 
-	if len(commits) != 1 {
-		t.Errorf("Expected 1 captured test commit, got %d", len(commits))
+	if len(commits) != 0 {
+		t.Errorf("Expected no commit while an earlier offset is pending, got %v", commits)
 	}
 	if acks.PendingSize() != 1 {
 		t.Errorf("Expected 1 remaining pending, got %d", acks.PendingSize())
 	}
 
-	acks.Ack(ctx, bucket.TransferOk, &info2)
+	acks.Ack(ctx, bucket.TransferOk, info1ptr2)
+	if err := acks.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
 
-	if len(commits) != 2 {
-		t.Errorf("Expected 2 captured test commit, got %d", len(commits))
+	if len(commits) != 1 {
+		t.Fatalf("Expected 1 captured test commit, got %d", len(commits))
+	}
+	if commits[0]["t"][0].Offset != 12 {
+		t.Errorf("Expected commit of the offset after the highest contiguous ack, got %v", commits[0])
 	}
 	if acks.PendingSize() != 0 {
 		t.Errorf("Expected 0 remaining pending, got %d", acks.PendingSize())
 	}
 
+	if err := acks.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 1 {
+		t.Errorf("Expected no commit when nothing advanced, got %d", len(commits))
+	}
+
+	info3 := newInfo("s3")
+	record3 := kgo.Record{Topic: "t", Partition: 1, Offset: 5}
+	acks.Expect(kafka.NewKafkaAckPending(&info3, &record3))
+	acks.Revoked(ctx, map[string][]int32{"t": {1}})
+	if acks.PendingSize() != 0 {
+		t.Errorf("Expected revoke to drop pending, got %d", acks.PendingSize())
+	}
+	acks.Ack(ctx, bucket.TransferOk, &info3)
+	if err := acks.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 1 {
+		t.Errorf("Expected no commit for a revoked partition, got %d", len(commits))
+	}
+
+}
+
+func TestAcksForget(t *testing.T) {
+	ctx := context.TODO()
+	metricPending := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "test_pending",
+	})
+	acks := kafka.NewKafkaAcks(zaptest.NewLogger(t), metricPending)
+	var commits []kafka.Offsets
+	acks.SetClientCommit(func(ctx context.Context, offsets kafka.Offsets) error {
+		commits = append(commits, offsets)
+		return nil
+	})
+
+	infos := make([]notification.Info, 2)
+	records := make([]kgo.Record, 2)
+	for i := range infos {
+		infos[i].Records = make([]notification.Event, 1)
+		infos[i].Records[0].S3.Object.Sequencer = fmt.Sprintf("s%d", i)
+		records[i] = kgo.Record{Topic: "t", Offset: int64(i)}
+		acks.Expect(kafka.NewKafkaAckPending(&infos[i], &records[i]))
+	}
+	// the second was never emitted, as the consumer stopped
+	acks.Forget(&records[1])
+	if acks.PendingSize() != 1 || testutil.ToFloat64(metricPending) != 1 {
+		t.Errorf("Expected forget to drop pending, got %d", acks.PendingSize())
+	}
+
+	acks.Ack(ctx, bucket.TransferOk, &infos[0])
+	if err := acks.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 1 || commits[0]["t"][0].Offset != 1 {
+		t.Errorf("Expected the final commit up to the forgotten offset, got %v", commits)
+	}
+}
+
+func TestAcksBatch(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	acks := kafka.NewKafkaAcks(zaptest.NewLogger(t), prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "test_pending",
+	}))
+	acks.SetCommitPolicy(time.Hour, 2)
+	committed := make(chan kafka.Offsets, 10)
+	acks.SetClientCommit(func(ctx context.Context, offsets kafka.Offsets) error {
+		committed <- offsets
+		return nil
+	})
+	go acks.Run(ctx)
+
+	infos := make([]notification.Info, 3)
+	for i := range infos {
+		infos[i].Records = make([]notification.Event, 1)
+		infos[i].Records[0].S3.Object.Sequencer = fmt.Sprintf("s%d", i)
+		acks.Expect(kafka.NewKafkaAckPending(&infos[i], &kgo.Record{Topic: "t", Offset: int64(i)}))
+	}
+
+	acks.Ack(ctx, bucket.TransferOk, &infos[0])
+	select {
+	case c := <-committed:
+		t.Errorf("Expected no commit before batch size, got %v", c)
+	case <-time.After(time.Millisecond * 50):
+	}
+	acks.Ack(ctx, bucket.TransferOk, &infos[1])
+	select {
+	case c := <-committed:
+		if c["t"][0].Offset != 2 {
+			t.Errorf("Unexpected commit %v", c)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected a commit at batch size")
+	}
+
+}
+
+func TestTransferRecord(t *testing.T) {
+
+	record, err := kafka.NewTransferRecord(&bucket.TransferEvent{
+		Outcome: bucket.OutcomeDuplicate,
+		Upload:  "dir/file.txt",
+		Key:     "ab/cd/abcd.txt",
+		Meta:    map[string]string{"Uploadpaths": "dir/file.txt"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(record.Key) != "dir/file.txt" {
+		t.Errorf("Record key should be the upload path, got %s", record.Key)
+	}
+	if len(record.Headers) != 1 || string(record.Headers[0].Value) != "duplicate" {
+		t.Errorf("Unexpected headers %v", record.Headers)
+	}
+	var event bucket.TransferEvent
+	if err := json.Unmarshal(record.Value, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Key != "ab/cd/abcd.txt" {
+		t.Errorf("Unexpected blob key %s", event.Key)
+	}
+	if event.Meta["Uploadpaths"] != "dir/file.txt" {
+		t.Errorf("Unexpected meta %v", event.Meta)
+	}
+
+}
+
+func TestDeadLetterRecord(t *testing.T) {
+
+	original := &kgo.Record{
+		Topic:     "notifications",
+		Partition: 3,
+		Offset:    42,
+		Key:       []byte("bucket/file.txt"),
+		Value:     []byte("{not json"),
+		Headers:   []kgo.RecordHeader{{Key: "origin", Value: []byte("minio")}},
+	}
+	record := kafka.NewDeadLetterRecord("dlt", original, "unmarshal: bad")
+	if record.Topic != "dlt" {
+		t.Errorf("Unexpected topic %s", record.Topic)
+	}
+	if string(record.Key) != "bucket/file.txt" || string(record.Value) != "{not json" {
+		t.Errorf("Key and value should be kept, got %s %s", record.Key, record.Value)
+	}
+	headers := map[string]string{}
+	for _, h := range record.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	if headers["origin"] != "minio" {
+		t.Errorf("Original headers should be kept, got %v", headers)
+	}
+	if headers["dlt-error"] != "unmarshal: bad" || headers["dlt-topic"] != "notifications" ||
+		headers["dlt-partition"] != "3" || headers["dlt-offset"] != "42" {
+		t.Errorf("Unexpected dead letter headers %v", headers)
+	}
+	if len(original.Headers) != 1 {
+		t.Errorf("Original record headers should be untouched, got %v", original.Headers)
+	}
+
+}
+
+func TestAuth(t *testing.T) {
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "auth.json")
+	if err := os.WriteFile(file, []byte(`{"saslMechanism":"SCRAM-SHA-512","saslUsername":"fromfile","saslPassword":"p"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"KAFKA_AUTH_CONFIG":   file,
+		"KAFKA_SASL_USERNAME": "fromenv",
+		"KAFKA_TLS":           "true",
+	}
+	auth, err := kafka.LoadKafkaAuth(func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.SaslMechanism != kafka.SaslScramSha512 || auth.SaslPassword != "p" {
+		t.Errorf("Expected config file values, got %v", auth)
+	}
+	if auth.SaslUsername != "fromenv" || !auth.Tls {
+		t.Errorf("Expected env to override file, got %v", auth)
+	}
+	opts, err := auth.Opts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts) != 2 {
+		t.Errorf("Expected SASL and TLS options, got %d", len(opts))
+	}
+
+	env["KAFKA_TLS"] = "maybe"
+	if _, err := kafka.LoadKafkaAuth(func(name string) string { return env[name] }); err == nil {
+		t.Error("Expected error for a non-boolean KAFKA_TLS")
+	}
+
+	var none *kafka.KafkaAuthConfig
+	if opts, err := none.Opts(); err != nil || len(opts) != 0 {
+		t.Errorf("Expected no options without auth, got %d %v", len(opts), err)
+	}
+	invalid := []kafka.KafkaAuthConfig{
+		{SaslMechanism: "GSSAPI"},
+		{SaslMechanism: kafka.SaslPlain},
+		{SaslMechanism: kafka.SaslOauthBearer},
+		{TlsCaFile: filepath.Join(dir, "missing.pem")},
+		{TlsCaFile: file},
+		{TlsCertFile: filepath.Join(dir, "cert.pem")},
+	}
+	for _, a := range invalid {
+		if _, err := a.Opts(); err == nil {
+			t.Errorf("Expected error for %v", a)
+		}
+	}
+	oauth := kafka.KafkaAuthConfig{SaslMechanism: "oauthbearer", OauthTokenFile: filepath.Join(dir, "token")}
+	if opts, err := oauth.Opts(); err != nil || len(opts) != 1 {
+		t.Errorf("Expected a SASL option for a token file, got %d %v", len(opts), err)
+	}
+
+}
+
+func TestAcksMultipleRecords(t *testing.T) {
+
+	ctx := context.TODO()
+	acks := kafka.NewKafkaAcks(zaptest.NewLogger(t), prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "test_pending",
+	}))
+	var commits []kafka.Offsets
+	acks.SetClientCommit(func(ctx context.Context, offsets kafka.Offsets) error {
+		commits = append(commits, offsets)
+		return nil
+	})
+
+	newInfo := func(keys ...string) notification.Info {
+		info := notification.Info{Records: make([]notification.Event, len(keys))}
+		for i, key := range keys {
+			info.Records[i].S3.Object.Key = key
+			info.Records[i].S3.Object.Sequencer = "s1"
+		}
+		return info
+	}
+	first := newInfo("a.txt", "b.txt")
+	second := newInfo("a.txt")
+	acks.Expect(kafka.NewKafkaAckPending(&first, &kgo.Record{Topic: "t", Offset: 0}))
+	acks.Expect(kafka.NewKafkaAckPending(&second, &kgo.Record{Topic: "t", Offset: 1}))
+	if len(acks.Pending()[0].Keys) != 2 {
+		t.Errorf("Expected both keys in pending description, got %v", acks.Pending()[0])
+	}
+
+	// a copy that went through the channel is matched to its own delivery, though another message has the same first record
+	secondCopy := second
+	acks.Ack(ctx, bucket.TransferOk, &secondCopy)
+	if err := acks.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 0 {
+		t.Errorf("Expected the multi record message to remain pending, got %v", commits)
+	}
+	firstCopy := first
+	acks.Ack(ctx, bucket.TransferOk, &firstCopy)
+	if err := acks.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 1 || commits[0]["t"][0].Offset != 2 {
+		t.Errorf("Expected a commit after both messages, got %v", commits)
+	}
+	if acks.PendingSize() != 0 {
+		t.Errorf("Expected 0 remaining pending, got %d", acks.PendingSize())
+	}
+
+}
+
+func TestAcksRevokeWaitsForStarted(t *testing.T) {
+
+	ctx := context.Background()
+	acks := kafka.NewKafkaAcks(zaptest.NewLogger(t), prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "test_pending",
+	}))
+	var commits []kafka.Offsets
+	acks.SetClientCommit(func(ctx context.Context, offsets kafka.Offsets) error {
+		commits = append(commits, offsets)
+		return nil
+	})
+
+	infos := make([]notification.Info, 2)
+	for i := range infos {
+		infos[i].Records = make([]notification.Event, 1)
+		infos[i].Records[0].S3.Object.Sequencer = fmt.Sprintf("s%d", i)
+		acks.Expect(kafka.NewKafkaAckPending(&infos[i], &kgo.Record{Topic: "t", Partition: 2, Offset: int64(i)}))
+	}
+	if !acks.Begin(&infos[0]) {
+		t.Fatal("Expected begin on an assigned partition")
+	}
+
+	revoked := make(chan struct{})
+	go func() {
+		acks.Revoked(ctx, map[string][]int32{"t": {2}})
+		close(revoked)
+	}()
+	time.Sleep(time.Millisecond * 100)
+	select {
+	case <-revoked:
+		t.Fatal("Expected revoke to wait for the started transfer")
+	default:
+	}
+	if acks.Begin(&infos[1]) {
+		t.Error("Expected no begin while the partition is being revoked")
+	}
+	acks.Ack(ctx, bucket.TransferOk, &infos[0])
+	select {
+	case <-revoked:
+	case <-time.After(time.Second):
+		t.Fatal("Expected revoke to complete after the ack")
+	}
+	if len(commits) != 1 || commits[0]["t"][2].Offset != 1 {
+		t.Errorf("Expected the finished offset to be committed on revoke, got %v", commits)
+	}
+	if acks.PendingSize() != 0 {
+		t.Errorf("Expected the unstarted notification to be dropped, got %d pending", acks.PendingSize())
+	}
+	if acks.Begin(&infos[1]) {
+		t.Error("Expected no begin after revoke")
+	}
+
+}
+
+func TestAcksRevokeSkipsAbandoned(t *testing.T) {
+	ctx := context.Background()
+	acks := kafka.NewKafkaAcks(zaptest.NewLogger(t), prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "test_pending",
+	}))
+	var commits []kafka.Offsets
+	acks.SetClientCommit(func(ctx context.Context, offsets kafka.Offsets) error {
+		commits = append(commits, offsets)
+		return nil
+	})
+
+	info := notification.Info{Records: make([]notification.Event, 1)}
+	info.Records[0].S3.Object.Sequencer = "s0"
+	acks.Expect(kafka.NewKafkaAckPending(&info, &kgo.Record{Topic: "t", Partition: 2, Offset: 0}))
+	if !acks.Begin(&info) {
+		t.Fatal("Expected begin on an assigned partition")
+	}
+	acks.Abandon(&info)
+
+	revoked := make(chan struct{})
+	go func() {
+		acks.Revoked(ctx, map[string][]int32{"t": {2}})
+		close(revoked)
+	}()
+	select {
+	case <-revoked:
+	case <-time.After(time.Second):
+		t.Fatal("Expected revoke not to wait for an abandoned notification")
+	}
+	for _, offsets := range commits {
+		if _, found := offsets["t"][2]; found {
+			t.Errorf("Expected the abandoned offset not to be committed, got %v", commits)
+		}
+	}
+}
+
+func TestAcksMetrics(t *testing.T) {
+
+	ctx := context.TODO()
+	acks := kafka.NewKafkaAcks(zaptest.NewLogger(t), prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "test_pending",
+	}))
+	lag := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_lag"}, []string{"topic", "partition"})
+	failures := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_commit_failures"})
+	acks.SetMetrics(lag, failures)
+	acks.SetClientCommit(func(ctx context.Context, offsets kafka.Offsets) error {
+		return fmt.Errorf("test commit failure")
+	})
+
+	if acks.OldestPending() != 0 {
+		t.Errorf("Expected zero age without pending, got %s", acks.OldestPending())
+	}
+	infos := make([]notification.Info, 3)
+	for i := range infos {
+		infos[i].Records = make([]notification.Event, 1)
+		infos[i].Records[0].S3.Object.Sequencer = fmt.Sprintf("s%d", i)
+		acks.Expect(kafka.NewKafkaAckPending(&infos[i], &kgo.Record{Topic: "t", Partition: 1, Offset: int64(20 + i)}))
+	}
+	acks.Fetched("t", 1, 30)
+	if v := testutil.ToFloat64(lag.WithLabelValues("t", "1")); v != 10 {
+		t.Errorf("Expected lag from the first unacked offset to the high watermark, got %f", v)
+	}
+	acks.Ack(ctx, bucket.TransferOk, &infos[0])
+	if v := testutil.ToFloat64(lag.WithLabelValues("t", "1")); v != 9 {
+		t.Errorf("Expected lag to shrink on ack, got %f", v)
+	}
+	time.Sleep(time.Millisecond * 10)
+	if acks.OldestPending() < time.Millisecond*10 {
+		t.Errorf("Expected oldest pending age, got %s", acks.OldestPending())
+	}
+
+	if err := acks.Flush(ctx); err == nil {
+		t.Error("Expected the commit error")
+	}
+	if v := testutil.ToFloat64(failures); v != 1 {
+		t.Errorf("Expected a commit failure count, got %f", v)
+	}
+
+	acks.Lost(map[string][]int32{"t": {1}})
+	if n := testutil.CollectAndCount(lag); n != 0 {
+		t.Errorf("Expected lag labels to be removed with the partition, got %d", n)
+	}
+
+}
+
+func TestParseOffsets(t *testing.T) {
+
+	offsets, err := kafka.ParseOffsets("minio-events:0:15, minio-events:2:0,with:colon:1:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offsets["minio-events"][0] != 15 || offsets["minio-events"][2] != 0 {
+		t.Errorf("Unexpected offsets %v", offsets)
+	}
+	if offsets["with:colon"][1] != 7 {
+		t.Errorf("Expected the topic to be everything before partition and offset, got %v", offsets)
+	}
+	for _, invalid := range []string{"", "t:1", ":1:2", "t:x:2", "t:1:-1", "t:1:2,t"} {
+		if _, err := kafka.ParseOffsets(invalid); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+
+}
+
+func TestReplayProgressGaps(t *testing.T) {
+
+	progress := kafka.NewReplayProgress([]kafka.ReplayPartition{
+		{Topic: "minio-events", Partition: 0, Start: 3, End: 10},
+		{Topic: "minio-events", Partition: 1, Start: 0, End: 5},
+		{Topic: "minio-events", Partition: 2, Start: 7, End: 7},
+	})
+	if progress.Remaining() != 2 {
+		t.Errorf("Expected an empty range to be done from the start, got %d remaining", progress.Remaining())
+	}
+	// offsets 8 and 9 were compacted away, superseded by records written after the replay started
+	for _, offset := range []int64{3, 5, 7} {
+		if !progress.Next(&kgo.Record{Topic: "minio-events", Partition: 0, Offset: offset}) {
+			t.Errorf("Expected offset %d to be replayed", offset)
+		}
+	}
+	// partition 1 has a gap at end-1 but has been written to since the replay started
+	if !progress.Next(&kgo.Record{Topic: "minio-events", Partition: 1, Offset: 2}) {
+		t.Error("Expected offset 2 to be replayed")
+	}
+	if progress.Next(&kgo.Record{Topic: "minio-events", Partition: 1, Offset: 5}) {
+		t.Error("Expected a record at the end offset not to be replayed")
+	}
+	if progress.Remaining() != 1 {
+		t.Errorf("Expected a record beyond the gap to finish the partition, got %d remaining", progress.Remaining())
+	}
+	if progress.Next(&kgo.Record{Topic: "minio-events", Partition: 1, Offset: 6}) {
+		t.Error("Expected a done partition not to be replayed")
+	}
+	if progress.Next(&kgo.Record{Topic: "minio-events", Partition: 2, Offset: 7}) {
+		t.Error("Expected an empty range not to be replayed")
+	}
+	if progress.Remaining() != 1 {
+		t.Errorf("Expected partition 0 to wait for its end offset, got %d remaining", progress.Remaining())
+	}
+	if progress.Next(&kgo.Record{Topic: "minio-events", Partition: 0, Offset: 12}) {
+		t.Error("Expected a superseding record beyond the end offset not to be replayed")
+	}
+	if progress.Remaining() != 0 {
+		t.Errorf("Expected the superseding record to finish the partition, got %d remaining", progress.Remaining())
+	}
+
 }
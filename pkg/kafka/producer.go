@@ -0,0 +1,83 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+)
+
+type KafkaProducerConfig struct {
+	Logger    *zap.Logger
+	Bootstrap []string
+	Topic     string
+	Auth      *KafkaAuthConfig
+}
+
+// KafkaProducer publishes transfer outcomes, keyed on upload path
+type KafkaProducer struct {
+	logger *zap.Logger
+	client *kgo.Client
+	topic  string
+}
+
+func NewKafkaProducer(config *KafkaProducerConfig) *KafkaProducer {
+	logger := config.Logger
+	cl, err := kgo.NewClient(
+		append(newClientOpts(logger, config.Bootstrap, config.Auth),
+			kgo.DefaultProduceTopic(config.Topic),
+			kgo.RequiredAcks(kgo.AllISRAcks()),
+		)...,
+	)
+	if err != nil {
+		logger.Fatal("Kafka producer client failure",
+			zap.Strings("bootstrap", config.Bootstrap),
+			zap.String("topic", config.Topic),
+			zap.Error(err),
+		)
+	}
+	logger.Info("Transfer events will be produced", zap.String("topic", config.Topic))
+	return &KafkaProducer{
+		logger: logger,
+		client: cl,
+		topic:  config.Topic,
+	}
+}
+
+func NewTransferRecord(event *bucket.TransferEvent) (*kgo.Record, error) {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return &kgo.Record{
+		Key:   []byte(event.Upload),
+		Value: value,
+		Headers: []kgo.RecordHeader{
+			{Key: "outcome", Value: []byte(event.Outcome)},
+		},
+	}, nil
+}
+
+// Publish returns after the broker has acknowledged the record, so that notification acks can follow
+func (p *KafkaProducer) Publish(ctx context.Context, event *bucket.TransferEvent) error {
+	record, err := NewTransferRecord(event)
+	if err != nil {
+		return err
+	}
+	if err := p.client.ProduceSync(ctx, record).FirstErr(); err != nil {
+		return err
+	}
+	p.logger.Debug("Produced transfer event",
+		zap.String("topic", record.Topic),
+		zap.Int32("partition", record.Partition),
+		zap.Int64("offset", record.Offset),
+		zap.String("outcome", string(event.Outcome)),
+	)
+	return nil
+}
+
+func (p *KafkaProducer) Close() {
+	p.client.Close()
+}
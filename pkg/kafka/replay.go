@@ -0,0 +1,296 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+)
+
+// ReplayConfig reads notifications again without a consumer group, so group offsets are unaffected
+type ReplayConfig struct {
+	Logger    *zap.Logger
+	Bootstrap []string
+	Topics    []string
+	Auth      *KafkaAuthConfig
+	Filter    MessageFilter
+	// From is where all partitions of Topics start, ignored if Offsets is set
+	From time.Time
+	// Offsets are explicit start offsets per topic and partition, other partitions are not replayed
+	Offsets map[string]map[int32]int64
+}
+
+// ReplayPartition is a range to replay, up to the end offset at the time the replay started
+type ReplayPartition struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Start     int64  `json:"start"`
+	End       int64  `json:"end"`
+}
+
+// ParseOffsets reads topic:partition:offset items separated by comma
+func ParseOffsets(value string) (map[string]map[int32]int64, error) {
+	offsets := make(map[string]map[int32]int64)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.LastIndex(item, ":")
+		j := strings.LastIndex(item[:max(i, 0)], ":")
+		if i == -1 || j < 1 {
+			return nil, fmt.Errorf("offset %q is not topic:partition:offset", item)
+		}
+		partition, err := strconv.ParseInt(item[j+1:i], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("offset %q partition: %w", item, err)
+		}
+		offset, err := strconv.ParseInt(item[i+1:], 10, 64)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("offset %q is not a non-negative number", item)
+		}
+		topic := item[:j]
+		if offsets[topic] == nil {
+			offsets[topic] = make(map[int32]int64)
+		}
+		offsets[topic][int32(partition)] = offset
+	}
+	if len(offsets) == 0 {
+		return nil, fmt.Errorf("no offsets in %q", value)
+	}
+	return offsets, nil
+}
+
+// listOffsets looks up an offset per partition, timestamp -1 meaning the end and otherwise the first record at or after it
+func listOffsets(ctx context.Context, cl *kgo.Client, partitions map[string][]int32, timestamp int64) (map[string]map[int32]int64, error) {
+	req := kmsg.NewPtrListOffsetsRequest()
+	for topic, ps := range partitions {
+		rt := kmsg.NewListOffsetsRequestTopic()
+		rt.Topic = topic
+		for _, p := range ps {
+			rp := kmsg.NewListOffsetsRequestTopicPartition()
+			rp.Partition = p
+			rp.Timestamp = timestamp
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		req.Topics = append(req.Topics, rt)
+	}
+	resp, err := req.RequestWith(ctx, cl)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[string]map[int32]int64)
+	for _, t := range resp.Topics {
+		offsets[t.Topic] = make(map[int32]int64)
+		for _, p := range t.Partitions {
+			if err := kerr.ErrorForCode(p.ErrorCode); err != nil {
+				return nil, fmt.Errorf("%s/%d: %w", t.Topic, p.Partition, err)
+			}
+			offsets[t.Topic][p.Partition] = p.Offset
+		}
+	}
+	return offsets, nil
+}
+
+func topicPartitions(ctx context.Context, cl *kgo.Client, topics []string) (map[string][]int32, error) {
+	req := kmsg.NewPtrMetadataRequest()
+	for _, topic := range topics {
+		rt := kmsg.NewMetadataRequestTopic()
+		rt.Topic = kmsg.StringPtr(topic)
+		req.Topics = append(req.Topics, rt)
+	}
+	resp, err := req.RequestWith(ctx, cl)
+	if err != nil {
+		return nil, err
+	}
+	partitions := make(map[string][]int32)
+	for _, t := range resp.Topics {
+		if err := kerr.ErrorForCode(t.ErrorCode); err != nil {
+			return nil, fmt.Errorf("%s: %w", *t.Topic, err)
+		}
+		for _, p := range t.Partitions {
+			partitions[*t.Topic] = append(partitions[*t.Topic], p.Partition)
+		}
+	}
+	return partitions, nil
+}
+
+// replayRanges resolves start offsets and captures end offsets, so that the replay terminates
+func replayRanges(ctx context.Context, cl *kgo.Client, config *ReplayConfig) ([]ReplayPartition, error) {
+	partitions := make(map[string][]int32)
+	if config.Offsets != nil {
+		for topic, ps := range config.Offsets {
+			for p := range ps {
+				partitions[topic] = append(partitions[topic], p)
+			}
+		}
+	} else {
+		var err error
+		if partitions, err = topicPartitions(ctx, cl, config.Topics); err != nil {
+			return nil, err
+		}
+	}
+	ends, err := listOffsets(ctx, cl, partitions, -1)
+	if err != nil {
+		return nil, err
+	}
+	starts := config.Offsets
+	if starts == nil {
+		if starts, err = listOffsets(ctx, cl, partitions, config.From.UnixMilli()); err != nil {
+			return nil, err
+		}
+	}
+	var ranges []ReplayPartition
+	for topic, ps := range partitions {
+		for _, p := range ps {
+			r := ReplayPartition{Topic: topic, Partition: p, Start: starts[topic][p], End: ends[topic][p]}
+			if r.Start < 0 {
+				// no records at or after the timestamp
+				r.Start = r.End
+			}
+			ranges = append(ranges, r)
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		if ranges[i].Topic != ranges[j].Topic {
+			return ranges[i].Topic < ranges[j].Topic
+		}
+		return ranges[i].Partition < ranges[j].Partition
+	})
+	return ranges, nil
+}
+
+// ReplayProgress tracks the partitions that have records left to replay.
+// Offsets have gaps, as compaction removes records and transaction markers take an offset,
+// so a partition is done at the first record at or beyond end-1.
+// Compaction only removes a record that a later one for the same key supersedes, so a gap at end-1 is followed by such a record.
+type ReplayProgress struct {
+	remaining map[topicPartition]int64
+}
+
+func NewReplayProgress(ranges []ReplayPartition) *ReplayProgress {
+	p := &ReplayProgress{remaining: make(map[topicPartition]int64)}
+	for _, r := range ranges {
+		if r.Start < r.End {
+			p.remaining[topicPartition{topic: r.Topic, partition: r.Partition}] = r.End
+		}
+	}
+	return p
+}
+
+// Next is true if the record is within a remaining range and should be emitted
+func (p *ReplayProgress) Next(record *kgo.Record) bool {
+	tp := topicPartition{topic: record.Topic, partition: record.Partition}
+	end, found := p.remaining[tp]
+	if !found {
+		return false
+	}
+	if record.Offset+1 >= end {
+		delete(p.remaining, tp)
+	}
+	return record.Offset < end && !record.Attrs.IsControl()
+}
+
+// Remaining is the number of partitions not yet done
+func (p *ReplayProgress) Remaining() int {
+	return len(p.remaining)
+}
+
+// NewReplay emits the notifications in the replay ranges, then closes Uploads. Acks are no-ops as there's no group.
+func NewReplay(ctx context.Context, config *ReplayConfig) (*bucket.InboxWatcher, []ReplayPartition) {
+	logger := config.Logger
+	filter := NewFilterPredicate(config.Filter, logger)
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
+
+	lookup, err := kgo.NewClient(newClientOpts(logger, config.Bootstrap, config.Auth)...)
+	if err != nil {
+		logger.Fatal("Kafka client failure", zap.Strings("bootstrap", config.Bootstrap), zap.Error(err))
+	}
+	ranges, err := replayRanges(ctx, lookup, config)
+	lookup.Close()
+	if err != nil {
+		logger.Fatal("Failed to resolve replay offsets", zap.Strings("topics", config.Topics), zap.Error(err))
+	}
+
+	consume := make(map[string]map[int32]kgo.Offset)
+	for _, r := range ranges {
+		logger.Info("Replay range", zap.Any("partition", r), zap.Int64("records", r.End-r.Start))
+		if r.Start >= r.End {
+			continue
+		}
+		if consume[r.Topic] == nil {
+			consume[r.Topic] = make(map[int32]kgo.Offset)
+		}
+		consume[r.Topic][r.Partition] = kgo.NewOffset().At(r.Start)
+	}
+	progress := NewReplayProgress(ranges)
+
+	ch := make(chan notification.Info)
+	watcher := &bucket.InboxWatcher{
+		Uploads: ch,
+		Ack: func(_ context.Context, result bucket.TransferResult, info *notification.Info) {
+			if result != bucket.TransferOk {
+				logger.Error("Replayed notification failed", zap.Any("info", info))
+			}
+		},
+	}
+	if len(consume) == 0 {
+		close(ch)
+		return watcher, ranges
+	}
+
+	cl, err := kgo.NewClient(append(newClientOpts(logger, config.Bootstrap, config.Auth),
+		kgo.ConsumePartitions(consume),
+		// markers take offsets too, so the partition can be seen to reach its end offset
+		kgo.KeepControlRecords(),
+	)...)
+	if err != nil {
+		logger.Fatal("Kafka client failure", zap.Strings("bootstrap", config.Bootstrap), zap.Error(err))
+	}
+	go func() {
+		defer close(ch)
+		defer cl.Close()
+		for progress.Remaining() > 0 {
+			// a slow fetch only delays the replay, which is done when every partition reaches its end offset
+			fetches := cl.PollFetches(ctx)
+			if ctx.Err() != nil {
+				logger.Info("Replay stopped", zap.Int("partitionsRemaining", progress.Remaining()))
+				return
+			}
+			if errs := fetches.Errors(); len(errs) > 0 {
+				logger.Fatal("Non-retryable consumer error", zap.String("errors", fmt.Sprint(errs)))
+			}
+			fetches.EachRecord(func(record *kgo.Record) {
+				if !progress.Next(record) || ctx.Err() != nil || !filter(record) {
+					return
+				}
+				var notificationInfo notification.Info
+				if err := json.Unmarshal(record.Value, &notificationInfo); err != nil {
+					logger.Error("Skipping replay of a record that isn't a notification",
+						zap.String("topic", record.Topic),
+						zap.Int32("partition", record.Partition),
+						zap.Int64("offset", record.Offset),
+						zap.Error(err),
+					)
+					return
+				}
+				select {
+				case ch <- notificationInfo:
+				case <-ctx.Done():
+				}
+			})
+		}
+		logger.Info("Replay reached the end offsets")
+	}()
+	return watcher, ranges
+}
@@ -0,0 +1,306 @@
+package listener
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+	"repos.se/minio-deduplication/v2/pkg/polling"
+)
+
+const (
+	initialIntervalDefault = time.Duration(time.Second * 1)
+	maxIntervalDefault     = time.Duration(time.Second * 30)
+	// stableAfter is how long a connection must last for the next failure to start over at the initial backoff
+	stableAfter = time.Duration(time.Minute * 1)
+	// catchUpMargin widens the gap to cover the server's ping interval and clock differences, as modification times are the server's
+	catchUpMargin = time.Duration(time.Second * 15)
+	// silentAfterDefault is three of the server's 10 second pings, that minio-go requests
+	silentAfterDefault = time.Duration(time.Second * 30)
+)
+
+var (
+	// metrics are package level, as the listener is created again when mainMinio re-runs
+	metricReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blobs_watch_listen_reconnects",
+		Help: "ListenBucketNotification reconnects, by error class",
+	}, []string{"class"})
+	metricCatchUp = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "blobs_watch_listen_catchup",
+		Help: "Objects emitted by catch-up listings after reconnects, some of which may also have been notified",
+	})
+)
+
+// errSilent is a connection without pings, classified as a stream that ended
+var errSilent = errors.New("no contact on bucket notifications connection")
+
+// ErrorClass says why a listen connection ended, and if it's worth reconnecting
+type ErrorClass string
+
+const (
+	// ClassStream is a connection that ended or was cut mid-event, typically at a proxy or server timeout
+	ClassStream ErrorClass = "stream"
+	// ClassNetwork is a failure to connect or a broken connection
+	ClassNetwork ErrorClass = "network"
+	// ClassServer is an S3 error response that may succeed later
+	ClassServer ErrorClass = "server"
+	// ClassPermanent is an S3 error response that reconnecting won't fix, such as access denied or a missing bucket
+	ClassPermanent ErrorClass = "permanent"
+)
+
+// Classify looks at error types only. Decoding errors from ListenBucketNotification aren't typed,
+// so anything unrecognized is assumed to be a truncated event, which is what a cut stream produces.
+func Classify(err error) ErrorClass {
+	var response minio.ErrorResponse
+	if errors.As(err, &response) {
+		switch {
+		case response.StatusCode >= http.StatusInternalServerError && response.StatusCode != http.StatusNotImplemented,
+			response.StatusCode == http.StatusTooManyRequests,
+			response.StatusCode == http.StatusRequestTimeout,
+			response.Code == "SlowDown":
+			return ClassServer
+		default:
+			return ClassPermanent
+		}
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, bufio.ErrTooLong) {
+		return ClassStream
+	}
+	var syntax *json.SyntaxError
+	if errors.As(err, &syntax) {
+		return ClassStream
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ClassStream
+		}
+		return ClassNetwork
+	}
+	return ClassStream
+}
+
+// Activity records when data was last read from ListenBucketNotification responses,
+// which includes the server's pings that minio-go doesn't pass on
+type Activity struct {
+	last atomic.Int64
+}
+
+// Transport wraps the minio client's transport, which is where the pings can be seen
+func (a *Activity) Transport(base http.RoundTripper) http.RoundTripper {
+	return roundTripper(func(req *http.Request) (*http.Response, error) {
+		res, err := base.RoundTrip(req)
+		if err == nil && req.Method == http.MethodGet && req.URL.Query().Has("ping") {
+			a.Seen()
+			res.Body = &activityBody{ReadCloser: res.Body, activity: a}
+		}
+		return res, err
+	})
+}
+
+// Seen records contact now
+func (a *Activity) Seen() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+// Last is the time of the latest contact, zero if there's been none
+func (a *Activity) Last() time.Time {
+	if nanos := a.last.Load(); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
+type roundTripper func(req *http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+type activityBody struct {
+	io.ReadCloser
+	activity *Activity
+}
+
+func (b *activityBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.activity.Seen()
+	}
+	return n, err
+}
+
+type ListenerConfig struct {
+	Logger *zap.Logger
+	Client *minio.Client
+	Bucket string
+	Events []string
+	// InitialInterval and MaxInterval bound the reconnect backoff, zero for defaults
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	// Activity should be the one whose Transport the client uses; if nil, only notifications count as contact
+	Activity *Activity
+	// SilentAfter is how long a connection may go without contact before it's presumed stuck and replaced, zero for default
+	SilentAfter time.Duration
+}
+
+// NewListener wraps ListenBucketNotification with reconnects until ctx is cancelled.
+// After a reconnect, objects modified since the last contact are emitted as synthetic notifications.
+// Permanent errors are fatal.
+func NewListener(ctx context.Context, config *ListenerConfig) *bucket.InboxWatcher {
+	logger := config.Logger
+	if config.InitialInterval == 0 {
+		config.InitialInterval = initialIntervalDefault
+	}
+	if config.MaxInterval == 0 {
+		config.MaxInterval = maxIntervalDefault
+	}
+	if config.SilentAfter == 0 {
+		config.SilentAfter = silentAfterDefault
+	}
+	if config.Activity == nil {
+		config.Activity = &Activity{}
+	}
+	// lastSeen is the latest contact, or when we started so that a listener that never connects goes silent
+	started := time.Now()
+	lastSeen := func() time.Time {
+		if last := config.Activity.Last(); last.After(started) {
+			return last
+		}
+		return started
+	}
+
+	policy := backoff.NewExponentialBackOff()
+	policy.InitialInterval = config.InitialInterval
+	policy.MaxInterval = config.MaxInterval
+	policy.MaxElapsedTime = 0
+
+	// catchUp emits objects modified since the gap started, and is false when ctx is done
+	catchUp := func(ch chan<- notification.Info, since time.Time) bool {
+		listCtx, cancelList := context.WithCancel(ctx)
+		defer cancelList()
+		emitted := 0
+		for object := range config.Client.ListObjects(listCtx, config.Bucket, minio.ListObjectsOptions{Recursive: true}) {
+			if object.Err != nil {
+				// notifications still flow, and the objects will be transferred at the next full listing
+				logger.Error("Catch-up listing failed", zap.Time("since", since), zap.Error(object.Err))
+				return ctx.Err() == nil
+			}
+			if object.LastModified.Before(since) {
+				continue
+			}
+			metricCatchUp.Inc()
+			emitted++
+			select {
+			case ch <- polling.NewInfo(config.Bucket, object):
+			case <-ctx.Done():
+				return false
+			}
+		}
+		logger.Info("Catch-up listing completed", zap.Time("since", since), zap.Int("emitted", emitted))
+		return ctx.Err() == nil
+	}
+
+	ch := make(chan notification.Info)
+	go func() {
+		defer close(ch)
+		var gapStart time.Time
+		for ctx.Err() == nil {
+			connCtx, cancelConn := context.WithCancel(ctx)
+			connected := time.Now()
+			uploads := config.Client.ListenBucketNotification(connCtx, config.Bucket, "", "", config.Events)
+			logger.Info("Listening for bucket notifications", zap.String("bucket", config.Bucket), zap.Strings("events", config.Events))
+			// a connection that stops sending pings without an error is replaced, as no error will come
+			var silent atomic.Bool
+			go func() {
+				ticker := time.NewTicker(config.SilentAfter / 4)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-connCtx.Done():
+						return
+					case <-ticker.C:
+						if seen := lastSeen(); time.Since(seen) > config.SilentAfter && time.Since(connected) > config.SilentAfter {
+							logger.Warn("No contact on bucket notifications connection, replacing it", zap.Time("lastseen", seen))
+							silent.Store(true)
+							cancelConn()
+							return
+						}
+					}
+				}
+			}()
+			if !gapStart.IsZero() && !catchUp(ch, gapStart.Add(-catchUpMargin)) {
+				cancelConn()
+				break
+			}
+
+			var err error
+			for info := range uploads {
+				if info.Err != nil {
+					err = info.Err
+					break
+				}
+				config.Activity.Seen()
+				policy.Reset()
+				select {
+				case ch <- info:
+				case <-ctx.Done():
+				}
+			}
+			cancelConn()
+			if ctx.Err() != nil {
+				break
+			}
+			if silent.Load() {
+				err = errSilent
+			} else if err == nil {
+				err = io.EOF
+			}
+			gapStart = lastSeen()
+			class := Classify(err)
+			if class == ClassPermanent {
+				logger.Fatal("Bucket notifications failed", zap.String("bucket", config.Bucket), zap.Error(err))
+			}
+			metricReconnects.With(prometheus.Labels{"class": string(class)}).Inc()
+			if time.Since(connected) > stableAfter {
+				policy.Reset()
+			}
+			delay := policy.NextBackOff()
+			logger.Info("Reconnecting bucket notifications",
+				zap.String("class", string(class)),
+				zap.Duration("delay", delay),
+				zap.Error(err),
+			)
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+		}
+		logger.Info("Bucket notifications listener stopped")
+	}()
+
+	return &bucket.InboxWatcher{
+		Uploads: ch,
+		Ack: func(_ context.Context, result bucket.TransferResult, info *notification.Info) {
+			if result == bucket.TransferFailed {
+				logger.Error("Nack on transfer failure not implemented", zap.Int("records", len(info.Records)))
+			} else {
+				logger.Debug("Ack is a no-op for ListenBucketNotification")
+			}
+		},
+		LastSeen: lastSeen,
+	}
+}
@@ -0,0 +1,200 @@
+package listener_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.uber.org/zap/zaptest"
+	"repos.se/minio-deduplication/v2/pkg/listener"
+	"repos.se/minio-deduplication/v2/pkg/polling"
+)
+
+func TestClassify(t *testing.T) {
+	cases := []struct {
+		err   error
+		class listener.ErrorClass
+	}{
+		{io.ErrUnexpectedEOF, listener.ClassStream},
+		{errors.New("readObjectStart: expect { or n, but found \x00"), listener.ClassStream},
+		{&url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, listener.ClassNetwork},
+		{minio.ErrorResponse{StatusCode: http.StatusServiceUnavailable, Code: "XMinioServerNotInitialized"}, listener.ClassServer},
+		{minio.ErrorResponse{StatusCode: http.StatusServiceUnavailable, Code: "SlowDown"}, listener.ClassServer},
+		{minio.ErrorResponse{StatusCode: http.StatusForbidden, Code: "AccessDenied"}, listener.ClassPermanent},
+		{minio.ErrorResponse{StatusCode: http.StatusNotFound, Code: "NoSuchBucket"}, listener.ClassPermanent},
+		{minio.ErrorResponse{StatusCode: http.StatusNotImplemented, Code: "APINotSupported"}, listener.ClassPermanent},
+		{fmt.Errorf("wrapped: %w", minio.ErrorResponse{StatusCode: http.StatusInternalServerError}), listener.ClassServer},
+	}
+	for _, c := range cases {
+		if class := listener.Classify(c.err); class != c.class {
+			t.Errorf("Expected %s for %v, got %s", c.class, c.err, class)
+		}
+	}
+}
+
+const listObjectsResult = `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>inbox</Name><KeyCount>2</KeyCount><MaxKeys>1000</MaxKeys><IsTruncated>false</IsTruncated>
+<Contents><Key>old.txt</Key><LastModified>2020-01-01T00:00:00.000Z</LastModified><ETag>"a"</ETag><Size>1</Size></Contents>
+<Contents><Key>gap.txt</Key><LastModified>%s</LastModified><ETag>"b"</ETag><Size>1</Size></Contents>
+</ListBucketResult>`
+
+func TestReconnectCatchUp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var connections atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("events") {
+			w.WriteHeader(http.StatusOK)
+			if connections.Add(1) == 1 {
+				fmt.Fprintln(w, `{"Records":[{"s3":{"bucket":{"name":"inbox"},"object":{"key":"first.txt"}}}]}`)
+				// a truncated event, like the one we get when a proxy cuts the connection
+				fmt.Fprintln(w, `{"Records":[{"s3":`)
+				return
+			}
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		if r.URL.Query().Get("list-type") == "2" {
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprintf(w, listObjectsResult, time.Now().UTC().Format("2006-01-02T15:04:05.000Z"))
+			return
+		}
+		t.Errorf("Unexpected request %s", r.URL)
+		w.WriteHeader(http.StatusNotImplemented)
+	}))
+	defer server.Close()
+
+	client, err := minio.New(server.Listener.Addr().String(), &minio.Options{
+		Creds:  credentials.NewStaticV4("a", "b", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher := listener.NewListener(ctx, &listener.ListenerConfig{
+		Logger:          zaptest.NewLogger(t),
+		Client:          client,
+		Bucket:          "inbox",
+		Events:          []string{"s3:ObjectCreated:Put"},
+		InitialInterval: time.Millisecond * 10,
+	})
+
+	next := func() string {
+		select {
+		case info := <-watcher.Uploads:
+			return info.Records[0].S3.Object.Key
+		case <-time.After(time.Second * 5):
+			t.Fatal("Timeout waiting for notification")
+			return ""
+		}
+	}
+	if key := next(); key != "first.txt" {
+		t.Errorf("Expected the notification before the error, got %s", key)
+	}
+	info := <-watcher.Uploads
+	if info.Err != nil {
+		t.Fatalf("Errors should be handled by the listener, got %v", info.Err)
+	}
+	if info.Records[0].S3.Object.Key != "gap.txt" || info.Records[0].EventSource != polling.EventSource {
+		t.Errorf("Expected only the object modified in the gap to be caught up, got %v", info.Records[0])
+	}
+	// the catch-up listing doesn't wait for the new connection
+	for start := time.Now(); connections.Load() < 2 && time.Since(start) < time.Second*5; {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if connections.Load() != 2 {
+		t.Errorf("Expected a reconnect, got %d connections", connections.Load())
+	}
+	if time.Since(watcher.LastSeen()) > time.Second {
+		t.Error("Expected contact while connected")
+	}
+
+	cancel()
+	for range watcher.Uploads {
+	}
+}
+
+func TestSilentReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var connections atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("events") {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			if connections.Add(1) == 1 {
+				// a stuck connection, without pings
+				<-r.Context().Done()
+				return
+			}
+			for {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(time.Millisecond * 20):
+					fmt.Fprint(w, " ")
+					w.(http.Flusher).Flush()
+				}
+			}
+		}
+		if r.URL.Query().Get("list-type") == "2" {
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprintf(w, listObjectsResult, "2020-01-01T00:00:00.000Z")
+			return
+		}
+		t.Errorf("Unexpected request %s", r.URL)
+		w.WriteHeader(http.StatusNotImplemented)
+	}))
+	defer server.Close()
+
+	activity := &listener.Activity{}
+	client, err := minio.New(server.Listener.Addr().String(), &minio.Options{
+		Creds:     credentials.NewStaticV4("a", "b", ""),
+		Region:    "us-east-1",
+		Transport: activity.Transport(http.DefaultTransport),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher := listener.NewListener(ctx, &listener.ListenerConfig{
+		Logger:          zaptest.NewLogger(t),
+		Client:          client,
+		Bucket:          "inbox",
+		Events:          []string{"s3:ObjectCreated:Put"},
+		InitialInterval: time.Millisecond * 10,
+		Activity:        activity,
+		SilentAfter:     time.Millisecond * 200,
+	})
+
+	for start := time.Now(); connections.Load() < 2 && time.Since(start) < time.Second*5; {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if connections.Load() != 2 {
+		t.Fatalf("Expected the silent connection to be replaced, got %d connections", connections.Load())
+	}
+	// pings keep the connection and count as contact
+	time.Sleep(time.Millisecond * 500)
+	if connections.Load() != 2 {
+		t.Errorf("Expected pings to keep the connection, got %d connections", connections.Load())
+	}
+	if time.Since(watcher.LastSeen()) > time.Millisecond*100 {
+		t.Errorf("Expected pings to count as contact, last seen %v", watcher.LastSeen())
+	}
+
+	cancel()
+	for range watcher.Uploads {
+	}
+}
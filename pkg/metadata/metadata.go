@@ -38,6 +38,18 @@ func AppendPath(list string, value string) string {
 	return list + separator + encoded
 }
 
+// SplitPaths is the inverse of AppendPath
+func SplitPaths(list string) []string {
+	if list == "" {
+		return []string{}
+	}
+	split := strings.Split(list, separator)
+	for i, path := range split {
+		split[i] = strings.ReplaceAll(path, "%3B", ";")
+	}
+	return split
+}
+
 func NewMetadataNext(uploaded, existing minio.ObjectInfo) *MetadataNext {
 	uploadpath := uploaded.Key
 	downloadName := filepath.Base(uploaded.Key)
@@ -76,3 +88,18 @@ func NewMetadataNext(uploaded, existing minio.ObjectInfo) *MetadataNext {
 		ReplaceMetadata: true, // TODO make false if we did not change _anything_
 	}
 }
+
+// NewMetadataQuarantine keeps the upload's metadata and records why it isn't archived
+func NewMetadataQuarantine(uploaded minio.ObjectInfo, reason string) *MetadataNext {
+	meta := make(map[string]string)
+	for k, v := range uploaded.UserMetadata {
+		meta[k] = v
+	}
+	meta["content-type"] = uploaded.ContentType
+	meta["Uploadpaths"] = encodePath(uploaded.Key)
+	meta["Quarantine-Reason"] = reason
+	return &MetadataNext{
+		UserMetadata:    meta,
+		ReplaceMetadata: true,
+	}
+}
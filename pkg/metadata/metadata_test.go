@@ -100,3 +100,41 @@ func TestNext(t *testing.T) {
 	}
 
 }
+
+func TestSplit(t *testing.T) {
+
+	empty := metadata.SplitPaths("")
+	if len(empty) != 0 {
+		t.Errorf("Unexpected %v", empty)
+	}
+
+	split := metadata.SplitPaths("my/path.png; /absolute/path.png; %3B strange%3BPATH.jpeg")
+	if len(split) != 3 {
+		t.Fatalf("Unexpected %v", split)
+	}
+	if split[1] != "/absolute/path.png" {
+		t.Errorf("Unexpected %s", split[1])
+	}
+	if split[2] != "; strange;PATH.jpeg" {
+		t.Errorf("Unexpected %s", split[2])
+	}
+
+}
+
+func TestQuarantine(t *testing.T) {
+	upload := minio.ObjectInfo{
+		Key:          "dir/~$report.docx",
+		ContentType:  "application/octet-stream",
+		UserMetadata: minio.StringMap{"X-Amz-Meta-Author": "a"},
+	}
+	q := metadata.NewMetadataQuarantine(upload, "exclude ~$*")
+	if q.UserMetadata["Quarantine-Reason"] != "exclude ~$*" {
+		t.Errorf("Unexpected reason: %s", q.UserMetadata["Quarantine-Reason"])
+	}
+	if q.UserMetadata["X-Amz-Meta-Author"] != "a" || q.UserMetadata["content-type"] != "application/octet-stream" {
+		t.Errorf("Expected upload metadata to be kept: %v", q.UserMetadata)
+	}
+	if q.UserMetadata["Uploadpaths"] != "dir/~$report.docx" {
+		t.Errorf("Unexpected upload path: %s", q.UserMetadata["Uploadpaths"])
+	}
+}
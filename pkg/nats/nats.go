@@ -0,0 +1,343 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+	"repos.se/minio-deduplication/v2/pkg/kafka"
+)
+
+const (
+	ackWaitDefault    = time.Duration(time.Minute * 5)
+	maxDeliverDefault = 5
+	nakDelayDefault   = time.Duration(time.Second * 30)
+	// flushTimeout bounds the flush of final acks at Close
+	flushTimeout = time.Duration(time.Second * 5)
+)
+
+type NatsConsumerConfig struct {
+	Logger *zap.Logger
+	Url    string
+	Stream string
+	// Subject filters the stream, empty for all subjects
+	Subject string
+	Durable string
+	// Filter is on the event's Key, which MinIO sets to bucket/key
+	Filter kafka.MessageFilter
+	// AckWait, MaxDeliver and NakDelay are zero for defaults; failed transfers are naked until MaxDeliver then termed
+	AckWait    time.Duration
+	MaxDeliver int
+	NakDelay   time.Duration
+}
+
+type NatsAckPending struct {
+	msg      jetstream.Msg
+	info     *notification.Info
+	received time.Time
+}
+
+// NatsAcks maps transfer results to JetStream ack, nak with delay, or term at max deliveries
+type NatsAcks struct {
+	logger        *zap.Logger
+	mu            sync.Mutex
+	pending       map[bucket.Delivery]*NatsAckPending
+	maxDeliver    int
+	nakDelay      time.Duration
+	metricPending prometheus.Gauge
+	metricAcks    *prometheus.CounterVec
+}
+
+func NewNatsAcks(logger *zap.Logger, maxDeliver int, nakDelay time.Duration, metricPending prometheus.Gauge, metricAcks *prometheus.CounterVec) *NatsAcks {
+	return &NatsAcks{
+		logger:        logger,
+		pending:       make(map[bucket.Delivery]*NatsAckPending),
+		maxDeliver:    maxDeliver,
+		nakDelay:      nakDelay,
+		metricPending: metricPending,
+		metricAcks:    metricAcks,
+	}
+}
+
+// Expect requires a notification with records, as they identify its delivery
+func (a *NatsAcks) Expect(msg jetstream.Msg, info *notification.Info) {
+	a.mu.Lock()
+	a.pending[bucket.DeliveryOf(info)] = &NatsAckPending{msg: msg, info: info, received: time.Now()}
+	a.mu.Unlock()
+	a.metricPending.Inc()
+}
+
+// remove must be called with mu held, and returns the message or nil if the notification isn't pending
+func (a *NatsAcks) remove(info *notification.Info) jetstream.Msg {
+	p, found := a.pending[bucket.DeliveryOf(info)]
+	if !found {
+		return nil
+	}
+	delete(a.pending, bucket.DeliveryOf(info))
+	a.metricPending.Dec()
+	return p.msg
+}
+
+// Begin resets the ack wait, as the transfer may have waited in a lane
+func (a *NatsAcks) Begin(info *notification.Info) bool {
+	a.mu.Lock()
+	p, found := a.pending[bucket.DeliveryOf(info)]
+	if !found {
+		a.mu.Unlock()
+		return false
+	}
+	msg := p.msg
+	a.mu.Unlock()
+	if err := msg.InProgress(); err != nil {
+		a.logger.Warn("Failed to signal in progress", zap.Error(err))
+	}
+	return true
+}
+
+func (a *NatsAcks) Ack(ackctx context.Context, result bucket.TransferResult, info *notification.Info) {
+	a.mu.Lock()
+	msg := a.remove(info)
+	a.mu.Unlock()
+	if msg == nil {
+		a.logger.Warn("Ack for a message that isn't pending, ignoring", zap.Any("info", info))
+		return
+	}
+
+	var err error
+	action := "ack"
+	if result == bucket.TransferOk {
+		err = msg.DoubleAck(ackctx)
+	} else if a.delivered(msg) < uint64(a.maxDeliver) {
+		action = "nak"
+		err = msg.NakWithDelay(a.nakDelay)
+	} else {
+		action = "term"
+		err = msg.TermWithReason("transfer failed after max deliveries")
+	}
+	a.metricAcks.With(prometheus.Labels{"action": action}).Inc()
+	if err != nil {
+		// the message will be redelivered after ack wait, and a redelivery of a completed transfer is a no-op
+		a.logger.Error("Failed to respond to message", zap.String("action", action), zap.Error(err))
+	}
+}
+
+// Forget is for notifications that won't be acked, at a stop, and naks them for a prompt redelivery
+func (a *NatsAcks) Forget(info *notification.Info) {
+	a.mu.Lock()
+	msg := a.remove(info)
+	a.mu.Unlock()
+	if msg == nil {
+		return
+	}
+	if err := msg.Nak(); err != nil {
+		// the message will be redelivered after ack wait
+		a.logger.Warn("Failed to nak abandoned message", zap.Error(err))
+	}
+}
+
+// Term is for messages that weren't emitted because they can't be processed
+func (a *NatsAcks) Term(msg jetstream.Msg, reason string) {
+	a.metricAcks.With(prometheus.Labels{"action": "term"}).Inc()
+	if err := msg.TermWithReason(reason); err != nil {
+		a.logger.Error("Failed to term message", zap.String("reason", reason), zap.Error(err))
+	}
+}
+
+func (a *NatsAcks) delivered(msg jetstream.Msg) uint64 {
+	meta, err := msg.Metadata()
+	if err != nil {
+		a.logger.Warn("No message metadata, assuming first delivery", zap.Error(err))
+		return 1
+	}
+	return meta.NumDelivered
+}
+
+func (a *NatsAcks) PendingSize() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.pending)
+}
+
+func (a *NatsAcks) Pending() []bucket.PendingAck {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pending := make([]bucket.PendingAck, 0, len(a.pending))
+	for _, p := range a.pending {
+		keys := make([]string, 0, len(p.info.Records))
+		for _, r := range p.info.Records {
+			keys = append(keys, r.S3.Object.Key)
+		}
+		source := p.msg.Subject()
+		if meta, err := p.msg.Metadata(); err == nil {
+			source = fmt.Sprintf("%s@%d", meta.Stream, meta.Sequence.Stream)
+		}
+		pending = append(pending, bucket.PendingAck{
+			Source:   source,
+			Keys:     keys,
+			Received: p.received,
+		})
+	}
+	bucket.SortPending(pending)
+	return pending
+}
+
+// NewNats consumes from a durable JetStream consumer until ctx is cancelled, while acks and Close use their own contexts
+func NewNats(ctx context.Context, config *NatsConsumerConfig) *bucket.InboxWatcher {
+	logger := config.Logger
+	filter := kafka.NewKeyFilterPredicate(config.Filter, logger)
+
+	if config.AckWait == 0 {
+		config.AckWait = ackWaitDefault
+	}
+	if config.MaxDeliver == 0 {
+		config.MaxDeliver = maxDeliverDefault
+	}
+	if config.NakDelay == 0 {
+		config.NakDelay = nakDelayDefault
+	}
+	acks := NewNatsAcks(logger, config.MaxDeliver, config.NakDelay,
+		bucket.Registered(prometheus.NewGauge(bucket.PendingGaugeOpts)),
+		bucket.Registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "blobs_watch_nats_acks",
+			Help: "Responses to JetStream messages, by action ack, nak or term",
+		}, []string{"action"})),
+	)
+
+	var contact bucket.Contact
+
+	nc, err := natsgo.Connect(config.Url,
+		natsgo.Name("minio-deduplication"),
+		natsgo.MaxReconnects(-1),
+		natsgo.DisconnectErrHandler(func(_ *natsgo.Conn, err error) {
+			if err != nil {
+				logger.Warn("NATS disconnected", zap.Error(err))
+			}
+		}),
+		natsgo.ReconnectHandler(func(c *natsgo.Conn) {
+			logger.Info("NATS reconnected", zap.String("url", c.ConnectedUrlRedacted()))
+		}),
+	)
+	if err != nil {
+		logger.Fatal("NATS connection failure", zap.String("url", config.Url), zap.Error(err))
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		logger.Fatal("JetStream context failure", zap.Error(err))
+	}
+	consumer, err := js.CreateOrUpdateConsumer(ctx, config.Stream, jetstream.ConsumerConfig{
+		Durable:       config.Durable,
+		FilterSubject: config.Subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       config.AckWait,
+		MaxDeliver:    config.MaxDeliver,
+	})
+	if err != nil {
+		logger.Fatal("JetStream consumer failure",
+			zap.String("stream", config.Stream),
+			zap.String("durable", config.Durable),
+			zap.Error(err),
+		)
+	}
+	messages, err := consumer.Messages()
+	if err != nil {
+		logger.Fatal("JetStream messages failure", zap.Error(err))
+	}
+	logger.Info("JetStream consumer started",
+		zap.String("stream", config.Stream),
+		zap.String("subject", config.Subject),
+		zap.String("durable", config.Durable),
+	)
+
+	ch := make(chan notification.Info)
+	result := &bucket.InboxWatcher{
+		Uploads:  ch,
+		Ack:      acks.Ack,
+		Pending:  acks.Pending,
+		Begin:    acks.Begin,
+		Abandon:  acks.Forget,
+		LastSeen: contact.LastSeen,
+		Close: func(closectx context.Context) {
+			messages.Stop()
+			logger.Info("Closing NATS connection", zap.Int("pending", acks.PendingSize()))
+			if _, hasDeadline := closectx.Deadline(); !hasDeadline {
+				var cancel context.CancelFunc
+				closectx, cancel = context.WithTimeout(closectx, flushTimeout)
+				defer cancel()
+			}
+			if err := nc.FlushWithContext(closectx); err != nil {
+				logger.Error("Final NATS flush failed", zap.Error(err))
+			}
+			nc.Close()
+		},
+	}
+
+	go func() {
+		contact.Heartbeat(ctx, nc.IsConnected)
+		// unblocks Next
+		messages.Stop()
+	}()
+
+	go func(notificationInfoCh chan<- notification.Info) {
+		defer close(notificationInfoCh)
+		for {
+			msg, err := messages.Next()
+			if ctx.Err() != nil {
+				logger.Info("NATS consumer stopped")
+				return
+			}
+			if errors.Is(err, jetstream.ErrMsgIteratorClosed) || nc.IsClosed() {
+				// the consumer was deleted, or the connection closed for good
+				logger.Error("NATS consumer ended", zap.Error(err))
+				bucket.SendLost(ctx, notificationInfoCh, err)
+				return
+			}
+			if err != nil {
+				logger.Warn("JetStream fetch error", zap.Error(err))
+				continue
+			}
+			contact.Seen()
+			var event bucket.Event
+			if err := json.Unmarshal(msg.Data(), &event); err != nil {
+				logger.Error("Failed to unmarshal notification",
+					zap.String("subject", msg.Subject()),
+					zap.ByteString("data", msg.Data()),
+					zap.Error(err),
+				)
+				acks.Term(msg, fmt.Sprintf("unmarshal: %s", err))
+				continue
+			}
+			if !filter(event.Key) {
+				logger.Debug("Filtered out", zap.String("key", event.Key))
+				if err := msg.Ack(); err != nil {
+					logger.Warn("Failed to ack filtered message", zap.Error(err))
+				}
+				continue
+			}
+			if len(event.Records) == 0 {
+				logger.Error("Got notification with zero records", zap.String("subject", msg.Subject()), zap.ByteString("data", msg.Data()))
+				acks.Term(msg, "zero records")
+				continue
+			}
+			logger.Info("Got notification", zap.String("subject", msg.Subject()), zap.String("key", event.Key))
+			notificationInfo := notification.Info{Records: event.Records}
+			acks.Expect(msg, &notificationInfo)
+			select {
+			case notificationInfoCh <- notificationInfo:
+			case <-ctx.Done():
+				// never emitted so never acked
+				acks.Forget(&notificationInfo)
+			}
+		}
+	}(ch)
+
+	return result
+}
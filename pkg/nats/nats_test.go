@@ -0,0 +1,143 @@
+package nats_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap/zaptest"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+	"repos.se/minio-deduplication/v2/pkg/nats"
+)
+
+// testMsg records responses, and panics on the jetstream.Msg methods we don't expect to be used
+type testMsg struct {
+	jetstream.Msg
+	delivered  uint64
+	response   string
+	nakDelay   time.Duration
+	inProgress int
+}
+
+func (m *testMsg) Metadata() (*jetstream.MsgMetadata, error) {
+	return &jetstream.MsgMetadata{NumDelivered: m.delivered, Stream: "minio"}, nil
+}
+
+func (m *testMsg) Subject() string { return "minio-events" }
+
+func (m *testMsg) DoubleAck(context.Context) error {
+	m.response = "ack"
+	return nil
+}
+
+func (m *testMsg) NakWithDelay(delay time.Duration) error {
+	m.response = "nak"
+	m.nakDelay = delay
+	return nil
+}
+
+func (m *testMsg) Nak() error {
+	m.response = "nak"
+	return nil
+}
+
+func (m *testMsg) TermWithReason(string) error {
+	m.response = "term"
+	return nil
+}
+
+func (m *testMsg) InProgress() error {
+	m.inProgress++
+	return nil
+}
+
+func TestAcks(t *testing.T) {
+
+	ctx := context.TODO()
+	pending := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_pending"})
+	actions := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_acks"}, []string{"action"})
+	acks := nats.NewNatsAcks(zaptest.NewLogger(t), 3, time.Second*7, pending, actions)
+
+	newInfo := func(sequencer string) notification.Info {
+		info := notification.Info{Records: make([]notification.Event, 1)}
+		info.Records[0].S3.Object.Key = "file.txt"
+		info.Records[0].S3.Object.Sequencer = sequencer
+		return info
+	}
+	ok, retry, last := newInfo("s1"), newInfo("s2"), newInfo("s3")
+	okMsg, retryMsg, lastMsg := &testMsg{delivered: 1}, &testMsg{delivered: 2}, &testMsg{delivered: 3}
+	acks.Expect(okMsg, &ok)
+	acks.Expect(retryMsg, &retry)
+	acks.Expect(lastMsg, &last)
+	if len(acks.Pending()) != 3 || acks.Pending()[0].Source != "minio@0" {
+		t.Errorf("Unexpected pending %v", acks.Pending())
+	}
+
+	// copies, like those that went through the channel
+	okCopy := ok
+	if !acks.Begin(&okCopy) || okMsg.inProgress != 1 {
+		t.Error("Expected begin to signal in progress")
+	}
+	acks.Ack(ctx, bucket.TransferOk, &okCopy)
+	if okMsg.response != "ack" {
+		t.Errorf("Expected ack, got %s", okMsg.response)
+	}
+	retryCopy := retry
+	acks.Ack(ctx, bucket.TransferFailed, &retryCopy)
+	if retryMsg.response != "nak" || retryMsg.nakDelay != time.Second*7 {
+		t.Errorf("Expected nak with delay below max deliveries, got %s %s", retryMsg.response, retryMsg.nakDelay)
+	}
+	lastCopy := last
+	acks.Ack(ctx, bucket.TransferFailed, &lastCopy)
+	if lastMsg.response != "term" {
+		t.Errorf("Expected term at max deliveries, got %s", lastMsg.response)
+	}
+
+	if acks.PendingSize() != 0 || testutil.ToFloat64(pending) != 0 {
+		t.Errorf("Expected nothing pending, got %d", acks.PendingSize())
+	}
+	if testutil.ToFloat64(actions.WithLabelValues("nak")) != 1 {
+		t.Error("Expected nak to be counted")
+	}
+	if acks.Begin(&okCopy) {
+		t.Error("Expected no begin for a message that was acked")
+	}
+
+}
+
+func TestAcksWithoutSequencer(t *testing.T) {
+
+	ctx := context.TODO()
+	pending := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_pending"})
+	actions := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_acks"}, []string{"action"})
+	acks := nats.NewNatsAcks(zaptest.NewLogger(t), 3, time.Second*7, pending, actions)
+
+	// identical records, as without a sequencer, are told apart by delivery
+	newInfo := func() notification.Info {
+		info := notification.Info{Records: make([]notification.Event, 1)}
+		info.Records[0].S3.Object.Key = "file.txt"
+		return info
+	}
+	first, second := newInfo(), newInfo()
+	firstMsg, secondMsg := &testMsg{delivered: 1}, &testMsg{delivered: 1}
+	acks.Expect(firstMsg, &first)
+	acks.Expect(secondMsg, &second)
+
+	secondCopy := second
+	acks.Ack(ctx, bucket.TransferOk, &secondCopy)
+	if secondMsg.response != "ack" || firstMsg.response != "" {
+		t.Errorf("Expected only the second message acked, got %q and %q", firstMsg.response, secondMsg.response)
+	}
+	acks.Forget(&first)
+	if firstMsg.response != "nak" {
+		t.Errorf("Expected a forgotten message to be naked for redelivery, got %q", firstMsg.response)
+	}
+	if acks.PendingSize() != 0 || testutil.ToFloat64(pending) != 0 {
+		t.Errorf("Expected nothing pending, got %d", acks.PendingSize())
+	}
+
+}
@@ -0,0 +1,161 @@
+package policy
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SniffLen is the number of leading bytes that Sniff looks at
+const SniffLen = 512
+
+var (
+	// generic is what http.DetectContentType returns when it recognizes nothing in particular,
+	// or a container such as zip for office documents, so it's not checked against allowed types
+	generic = map[string]bool{
+		"application/octet-stream": true,
+		"text/plain":               true,
+		"application/zip":          true,
+	}
+	// detectable are types that http.DetectContentType recognizes reliably from the leading bytes,
+	// so a declared type in this set that sniffs as something else is a mismatch
+	detectable = map[string]bool{
+		"image/x-icon":                 true,
+		"image/bmp":                    true,
+		"image/gif":                    true,
+		"image/webp":                   true,
+		"image/png":                    true,
+		"image/jpeg":                   true,
+		"audio/aiff":                   true,
+		"audio/mpeg":                   true,
+		"audio/wave":                   true,
+		"audio/midi":                   true,
+		"application/ogg":              true,
+		"video/avi":                    true,
+		"video/mp4":                    true,
+		"video/webm":                   true,
+		"font/ttf":                     true,
+		"font/otf":                     true,
+		"font/woff":                    true,
+		"font/woff2":                   true,
+		"application/pdf":              true,
+		"application/zip":              true,
+		"application/x-gzip":           true,
+		"application/wasm":             true,
+		"application/x-rar-compressed": true,
+	}
+	// aliases are declared types that http.DetectContentType names differently
+	aliases = map[string]string{
+		"image/jpg":                    "image/jpeg",
+		"image/pjpeg":                  "image/jpeg",
+		"image/vnd.microsoft.icon":     "image/x-icon",
+		"audio/mp3":                    "audio/mpeg",
+		"audio/wav":                    "audio/wave",
+		"audio/x-wav":                  "audio/wave",
+		"audio/x-aiff":                 "audio/aiff",
+		"video/x-msvideo":              "video/avi",
+		"application/gzip":             "application/x-gzip",
+		"application/x-zip-compressed": "application/zip",
+		"application/vnd.rar":          "application/x-rar-compressed",
+	}
+)
+
+// MediaType is the lower case type/subtype without parameters, or application/octet-stream if there's none
+func MediaType(contentType string) string {
+	media, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		media, _, _ = strings.Cut(contentType, ";")
+		media = strings.ToLower(strings.TrimSpace(media))
+	}
+	if media == "" {
+		return "application/octet-stream"
+	}
+	if alias, found := aliases[media]; found {
+		return alias
+	}
+	return media
+}
+
+// Sniff returns the media type detected from up to SniffLen leading bytes, or empty for no bytes
+func Sniff(head []byte) string {
+	if len(head) == 0 {
+		return ""
+	}
+	return MediaType(http.DetectContentType(head))
+}
+
+// ContentPolicy archives only uploads with an allowed declared type, and with content that doesn't contradict it.
+// Allow patterns are type/subtype or type/*.
+// Only types that http.DetectContentType recognizes can be checked against content,
+// for example an executable declared as image/png is a mismatch but one declared as image/tiff is not.
+type ContentPolicy struct {
+	Allow    []string
+	Action   Action
+	rejected *prometheus.CounterVec
+}
+
+func NewContentPolicy(allow []string, action Action, registerer prometheus.Registerer) (*ContentPolicy, error) {
+	p := &ContentPolicy{
+		Action: action,
+		rejected: promauto.With(registerer).NewCounterVec(prometheus.CounterOpts{
+			Name: "blobs_ignored_content",
+			Help: "The number of uploads rejected by the content type policy, by check declared, sniffed or mismatch and action",
+		}, []string{"check", "action"}),
+	}
+	for _, value := range allow {
+		pattern := strings.ToLower(strings.TrimSpace(value))
+		major, minor, found := strings.Cut(pattern, "/")
+		if !found || major == "" || major == "*" || minor == "" || strings.Contains(minor, "/") {
+			return nil, fmt.Errorf("content type %q is not type/subtype or type/*", value)
+		}
+		if minor != "*" {
+			pattern = MediaType(pattern)
+		}
+		p.Allow = append(p.Allow, pattern)
+	}
+	return p, nil
+}
+
+func (p *ContentPolicy) Enabled() bool {
+	return p != nil && len(p.Allow) > 0
+}
+
+// Allowed is true if the media type matches an allow pattern
+func (p *ContentPolicy) Allowed(media string) bool {
+	for _, pattern := range p.Allow {
+		if pattern == media {
+			return true
+		}
+		if major, found := strings.CutSuffix(pattern, "/*"); found && strings.HasPrefix(media, major+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns the reason an upload is rejected, and counts it, or empty if it's admitted.
+// The sniffed type is from Sniff, and empty skips the content checks.
+func (p *ContentPolicy) Check(declared, sniffed string) string {
+	if !p.Enabled() {
+		return ""
+	}
+	declared = MediaType(declared)
+	check, reason := "", ""
+	switch {
+	case !p.Allowed(declared):
+		check, reason = "declared", fmt.Sprintf("content type %s not allowed", declared)
+	case sniffed == "":
+	case detectable[declared] && sniffed != declared:
+		check, reason = "mismatch", fmt.Sprintf("declared %s but sniffed %s", declared, sniffed)
+	case !generic[sniffed] && !p.Allowed(sniffed):
+		check, reason = "sniffed", fmt.Sprintf("sniffed %s not allowed", sniffed)
+	}
+	if reason != "" {
+		p.rejected.With(prometheus.Labels{"check": check, "action": string(p.Action)}).Inc()
+	}
+	return reason
+}
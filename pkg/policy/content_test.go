@@ -0,0 +1,84 @@
+package policy_test
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"repos.se/minio-deduplication/v2/pkg/policy"
+)
+
+var (
+	png = []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR")
+	pdf = []byte("%PDF-1.7\n")
+	exe = []byte("MZ\x90\x00\x03\x00\x00\x00\x04\x00\x00\x00\xff\xff")
+	zip = []byte("PK\x03\x04\x14\x00\x06\x00")
+	htm = []byte("<!DOCTYPE html><html>")
+)
+
+func TestSniff(t *testing.T) {
+	if s := policy.Sniff(png); s != "image/png" {
+		t.Errorf("Unexpected %s", s)
+	}
+	if s := policy.Sniff([]byte("plain text")); s != "text/plain" {
+		t.Errorf("Expected no charset parameter, got %s", s)
+	}
+	if s := policy.Sniff(nil); s != "" {
+		t.Errorf("Expected nothing to sniff for an empty upload, got %s", s)
+	}
+	if m := policy.MediaType("Image/JPG; name=a.jpg"); m != "image/jpeg" {
+		t.Errorf("Expected a normalized alias, got %s", m)
+	}
+	if m := policy.MediaType(""); m != "application/octet-stream" {
+		t.Errorf("Expected the default type, got %s", m)
+	}
+}
+
+func TestContentPolicy(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	p, err := policy.NewContentPolicy([]string{"image/*", "application/pdf", "application/vnd.openxmlformats-officedocument.wordprocessingml.document"}, policy.ActionQuarantine, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Enabled() {
+		t.Error("Expected the policy to be enabled with allowed types")
+	}
+	cases := []struct {
+		declared string
+		head     []byte
+		reason   string
+	}{
+		{"image/png", png, ""},
+		{"application/pdf", pdf, ""},
+		{"image/tiff", exe, ""},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", zip, ""},
+		{"image/jpeg", nil, ""},
+		{"image/png", exe, "declared image/png but sniffed application/octet-stream"},
+		{"image/jpg", png, "declared image/jpeg but sniffed image/png"},
+		{"application/x-msdownload", exe, "content type application/x-msdownload not allowed"},
+		{"", pdf, "content type application/octet-stream not allowed"},
+		{"image/tiff", htm, "sniffed text/html not allowed"},
+	}
+	for _, c := range cases {
+		if reason := p.Check(c.declared, policy.Sniff(c.head)); reason != c.reason {
+			t.Errorf("Expected %q for %s, got %q", c.reason, c.declared, reason)
+		}
+	}
+	if count := testutil.CollectAndCount(registry, "blobs_ignored_content"); count != 3 {
+		t.Errorf("Expected a count per check, got %d", count)
+	}
+
+	none, err := policy.NewContentPolicy(nil, policy.ActionLeave, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if none.Enabled() || none.Check("application/x-msdownload", policy.Sniff(exe)) != "" {
+		t.Error("Expected no allowed types to admit everything")
+	}
+
+	for _, invalid := range []string{"image", "*/*", "image/", "a/b/c"} {
+		if _, err := policy.NewContentPolicy([]string{invalid}, policy.ActionLeave, prometheus.NewRegistry()); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Action is what happens to an upload that a policy rejects
+type Action string
+
+const (
+	// ActionLeave keeps the upload in the inbox, neither archived nor removed
+	ActionLeave Action = "leave"
+	// ActionDrop removes the upload from the inbox, like --dropempty
+	ActionDrop Action = "drop"
+	// ActionQuarantine moves the upload to the quarantine bucket
+	ActionQuarantine Action = "quarantine"
+)
+
+func ParseAction(value string) (Action, error) {
+	switch a := Action(value); a {
+	case ActionLeave, ActionDrop, ActionQuarantine:
+		return a, nil
+	}
+	return "", fmt.Errorf("action %q is not leave, drop or quarantine", value)
+}
+
+const regexPrefix = "regex:"
+
+// Rule matches upload keys with a glob, or a regular expression if prefixed regex:.
+// Globs use path.Match and, unless they contain a slash, match the base name in any directory.
+type Rule struct {
+	value string
+	glob  string
+	regex *regexp.Regexp
+}
+
+func ParseRule(value string) (Rule, error) {
+	if pattern, found := strings.CutPrefix(value, regexPrefix); found {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return Rule{}, fmt.Errorf("rule %q: %w", value, err)
+		}
+		return Rule{value: value, regex: regex}, nil
+	}
+	glob := strings.TrimPrefix(value, "glob:")
+	if glob == "" {
+		return Rule{}, fmt.Errorf("rule %q is empty", value)
+	}
+	if _, err := path.Match(glob, ""); err != nil {
+		return Rule{}, fmt.Errorf("rule %q: %w", value, err)
+	}
+	return Rule{value: value, glob: glob}, nil
+}
+
+func (r Rule) Match(key string) bool {
+	if r.regex != nil {
+		return r.regex.MatchString(key)
+	}
+	name := key
+	if !strings.Contains(r.glob, "/") {
+		name = path.Base(key)
+	}
+	match, _ := path.Match(r.glob, name)
+	return match
+}
+
+func (r Rule) String() string {
+	return r.value
+}
+
+// KeyPolicy excludes uploads that match an exclude rule, or that match no include rule if there are any
+type KeyPolicy struct {
+	Include  []Rule
+	Exclude  []Rule
+	Action   Action
+	excluded *prometheus.CounterVec
+}
+
+func NewKeyPolicy(include, exclude []string, action Action, registerer prometheus.Registerer) (*KeyPolicy, error) {
+	p := &KeyPolicy{
+		Action: action,
+		excluded: promauto.With(registerer).NewCounterVec(prometheus.CounterOpts{
+			Name: "blobs_ignored_excluded",
+			Help: "The number of uploads excluded by include or exclude rules on the key, by rule and action",
+		}, []string{"rule", "action"}),
+	}
+	for _, value := range include {
+		rule, err := ParseRule(value)
+		if err != nil {
+			return nil, err
+		}
+		p.Include = append(p.Include, rule)
+	}
+	for _, value := range exclude {
+		rule, err := ParseRule(value)
+		if err != nil {
+			return nil, err
+		}
+		p.Exclude = append(p.Exclude, rule)
+	}
+	return p, nil
+}
+
+// Enabled is false when there are no rules, so that every key is included
+func (p *KeyPolicy) Enabled() bool {
+	return p != nil && len(p.Include)+len(p.Exclude) > 0
+}
+
+// Reason returns why a key is excluded, or empty if it's included, without counting it
+func (p *KeyPolicy) Reason(key string) string {
+	if !p.Enabled() {
+		return ""
+	}
+	for _, rule := range p.Exclude {
+		if rule.Match(key) {
+			return "exclude " + rule.String()
+		}
+	}
+	if len(p.Include) == 0 {
+		return ""
+	}
+	for _, rule := range p.Include {
+		if rule.Match(key) {
+			return ""
+		}
+	}
+	return "no include match"
+}
+
+// Check returns the reason a key is excluded, and counts it, or empty if it's included
+func (p *KeyPolicy) Check(key string) string {
+	reason := p.Reason(key)
+	if reason != "" {
+		p.excluded.With(prometheus.Labels{"rule": reason, "action": string(p.Action)}).Inc()
+	}
+	return reason
+}
@@ -0,0 +1,93 @@
+package policy_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"repos.se/minio-deduplication/v2/pkg/policy"
+)
+
+func TestRule(t *testing.T) {
+	cases := []struct {
+		rule  string
+		key   string
+		match bool
+	}{
+		{"*.part", "dir/file.part", true},
+		{"*.part", "file.part.txt", false},
+		{"~$*", "docs/~$report.docx", true},
+		{".DS_Store", "a/b/.DS_Store", true},
+		{"glob:tmp/*", "tmp/a.txt", true},
+		{"tmp/*", "other/tmp/a.txt", false},
+		{"regex:(^|/)\\.~lock\\..*#$", "dir/.~lock.report.odt#", true},
+		{"regex:^tmp/", "dir/tmp/a.txt", false},
+	}
+	for _, c := range cases {
+		rule, err := policy.ParseRule(c.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule.Match(c.key) != c.match {
+			t.Errorf("Expected %s match %v for %s", c.rule, c.match, c.key)
+		}
+	}
+	for _, invalid := range []string{"", "[", "regex:("} {
+		if _, err := policy.ParseRule(invalid); err == nil {
+			t.Errorf("Expected an error for rule %q", invalid)
+		}
+	}
+}
+
+func TestKeyPolicy(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	p, err := policy.NewKeyPolicy([]string{"*.pdf", "*.txt"}, []string{"~$*"}, policy.ActionDrop, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Enabled() {
+		t.Error("Expected the policy to be enabled with rules")
+	}
+	if reason := p.Check("dir/a.pdf"); reason != "" {
+		t.Errorf("Expected an included key, got %s", reason)
+	}
+	if reason := p.Check("dir/~$a.txt"); reason != "exclude ~$*" {
+		t.Errorf("Expected exclude to take precedence over include, got %s", reason)
+	}
+	if reason := p.Check("dir/a.docx"); reason != "no include match" {
+		t.Errorf("Expected keys matching no include rule to be excluded, got %s", reason)
+	}
+	if count := testutil.CollectAndCount(registry, "blobs_ignored_excluded"); count != 2 {
+		t.Errorf("Expected a count per rule, got %d", count)
+	}
+	if reason := p.Reason("dir/a.docx"); reason != "no include match" {
+		t.Errorf("Expected the same reason without counting, got %s", reason)
+	}
+	expected := `
+# HELP blobs_ignored_excluded The number of uploads excluded by include or exclude rules on the key, by rule and action
+# TYPE blobs_ignored_excluded counter
+blobs_ignored_excluded{action="drop",rule="exclude ~$*"} 1
+blobs_ignored_excluded{action="drop",rule="no include match"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "blobs_ignored_excluded"); err != nil {
+		t.Errorf("Expected Reason not to count: %v", err)
+	}
+
+	none, err := policy.NewKeyPolicy(nil, nil, policy.ActionLeave, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if none.Enabled() || none.Check(".DS_Store") != "" {
+		t.Error("Expected no rules to include everything")
+	}
+}
+
+func TestParseAction(t *testing.T) {
+	if a, err := policy.ParseAction("quarantine"); err != nil || a != policy.ActionQuarantine {
+		t.Errorf("Unexpected %s %v", a, err)
+	}
+	if _, err := policy.ParseAction("delete"); err == nil {
+		t.Error("Expected an error for an unknown action")
+	}
+}
@@ -0,0 +1,68 @@
+package policy
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SizePolicy rejects uploads outside Min and Max bytes, checked at stat before the upload is read
+type SizePolicy struct {
+	// Min and Max are inclusive limits, zero for no limit
+	Min      int64
+	Max      int64
+	Action   Action
+	rejected *prometheus.CounterVec
+}
+
+func NewSizePolicy(min, max int64, action Action, registerer prometheus.Registerer) (*SizePolicy, error) {
+	if min < 0 || max < 0 {
+		return nil, fmt.Errorf("size limits must not be negative, got min %d max %d", min, max)
+	}
+	if max != 0 && min > max {
+		return nil, fmt.Errorf("min size %d is larger than max size %d", min, max)
+	}
+	return &SizePolicy{
+		Min:    min,
+		Max:    max,
+		Action: action,
+		rejected: promauto.With(registerer).NewCounterVec(prometheus.CounterOpts{
+			Name: "blobs_ignored_size",
+			Help: "The number of uploads rejected by the size policy, by limit min or max and action",
+		}, []string{"limit", "action"}),
+	}, nil
+}
+
+func (p *SizePolicy) Enabled() bool {
+	return p != nil && (p.Min > 0 || p.Max > 0)
+}
+
+// Reason returns why a size is rejected, or empty if it's admitted, without counting it
+func (p *SizePolicy) Reason(size int64) string {
+	_, reason := p.limit(size)
+	return reason
+}
+
+// Check returns the reason a size is rejected, and counts it, or empty if it's admitted
+func (p *SizePolicy) Check(size int64) string {
+	limit, reason := p.limit(size)
+	if reason != "" {
+		p.rejected.With(prometheus.Labels{"limit": limit, "action": string(p.Action)}).Inc()
+	}
+	return reason
+}
+
+// limit returns the limit, min or max, that the size is outside of and the reason
+func (p *SizePolicy) limit(size int64) (string, string) {
+	if !p.Enabled() {
+		return "", ""
+	}
+	if p.Min > 0 && size < p.Min {
+		return "min", fmt.Sprintf("size %d below min %d", size, p.Min)
+	}
+	if p.Max > 0 && size > p.Max {
+		return "max", fmt.Sprintf("size %d above max %d", size, p.Max)
+	}
+	return "", ""
+}
@@ -0,0 +1,70 @@
+package policy_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"repos.se/minio-deduplication/v2/pkg/policy"
+)
+
+func TestSizePolicy(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	p, err := policy.NewSizePolicy(10, 100, policy.ActionQuarantine, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Enabled() {
+		t.Error("Expected the policy to be enabled with limits")
+	}
+	for _, size := range []int64{10, 50, 100} {
+		if reason := p.Check(size); reason != "" {
+			t.Errorf("Expected limits to be inclusive, got %s", reason)
+		}
+	}
+	if reason := p.Check(9); reason != "size 9 below min 10" {
+		t.Errorf("Unexpected reason %s", reason)
+	}
+	if reason := p.Check(101); reason != "size 101 above max 100" {
+		t.Errorf("Unexpected reason %s", reason)
+	}
+	if count := testutil.CollectAndCount(registry, "blobs_ignored_size"); count != 2 {
+		t.Errorf("Expected a count per limit, got %d", count)
+	}
+	if reason := p.Reason(9); reason != "size 9 below min 10" {
+		t.Errorf("Expected the same reason without counting, got %s", reason)
+	}
+	expected := `
+# HELP blobs_ignored_size The number of uploads rejected by the size policy, by limit min or max and action
+# TYPE blobs_ignored_size counter
+blobs_ignored_size{action="quarantine",limit="max"} 1
+blobs_ignored_size{action="quarantine",limit="min"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "blobs_ignored_size"); err != nil {
+		t.Errorf("Expected Reason not to count: %v", err)
+	}
+
+	maxOnly, err := policy.NewSizePolicy(0, 100, policy.ActionLeave, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxOnly.Check(0) != "" {
+		t.Error("Expected no min limit")
+	}
+
+	none, err := policy.NewSizePolicy(0, 0, policy.ActionLeave, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if none.Enabled() || none.Check(1<<40) != "" {
+		t.Error("Expected no limits to admit every size")
+	}
+
+	if _, err := policy.NewSizePolicy(100, 10, policy.ActionLeave, prometheus.NewRegistry()); err == nil {
+		t.Error("Expected an error for min above max")
+	}
+	if _, err := policy.NewSizePolicy(-1, 0, policy.ActionLeave, prometheus.NewRegistry()); err == nil {
+		t.Error("Expected an error for a negative limit")
+	}
+}
@@ -0,0 +1,222 @@
+package polling
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+)
+
+const (
+	intervalDefault = time.Duration(time.Second * 30)
+	minAgeDefault   = time.Duration(time.Second * 10)
+	// EventSource marks synthetic records, which have no sequencer
+	EventSource = "minio-deduplication:polling"
+	eventName   = "s3:ObjectCreated:Put"
+)
+
+// PollingConfig is for S3 servers without bucket notifications
+type PollingConfig struct {
+	Logger *zap.Logger
+	Client *minio.Client
+	Bucket string
+	// Interval is the delay between listings, zero for default
+	Interval time.Duration
+	// MinAge skips objects modified more recently, for gateways that expose objects while they're written. Zero for default.
+	MinAge time.Duration
+	// Skip, if set, is true for objects that should not be emitted, such as those that are left in the inbox by policy
+	Skip func(object minio.ObjectInfo) bool
+}
+
+// NewInfo is a notification with a single record for a listed object, with the key not url encoded
+func NewInfo(bucketName string, object minio.ObjectInfo) notification.Info {
+	record := notification.Event{
+		EventVersion: "2.0",
+		EventSource:  EventSource,
+		EventTime:    object.LastModified.UTC().Format(time.RFC3339Nano),
+		EventName:    eventName,
+	}
+	record.S3.Bucket.Name = bucketName
+	record.S3.Object.Key = object.Key
+	record.S3.Object.Size = object.Size
+	record.S3.Object.ETag = object.ETag
+	return notification.Info{Records: []notification.Event{record}}
+}
+
+type inflightKey struct {
+	key      string
+	received time.Time
+}
+
+// Inflight tracks emitted keys until they're acked, so that a listing doesn't emit them again.
+// A failed transfer is released too, and retried at the next listing if it's still in the inbox.
+type Inflight struct {
+	logger        *zap.Logger
+	mu            sync.Mutex
+	keys          []inflightKey
+	metricPending prometheus.Gauge
+}
+
+func NewInflight(logger *zap.Logger, metricPending prometheus.Gauge) *Inflight {
+	return &Inflight{
+		logger:        logger,
+		metricPending: metricPending,
+	}
+}
+
+// Expect is false if the key is already in flight
+func (f *Inflight) Expect(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, k := range f.keys {
+		if k.key == key {
+			return false
+		}
+	}
+	f.keys = append(f.keys, inflightKey{key: key, received: time.Now()})
+	f.metricPending.Inc()
+	return true
+}
+
+func (f *Inflight) Ack(_ context.Context, result bucket.TransferResult, info *notification.Info) {
+	for _, r := range info.Records {
+		if !f.release(r.S3.Object.Key) {
+			f.logger.Warn("Ack for a key that isn't in flight, ignoring", zap.String("key", r.S3.Object.Key))
+			continue
+		}
+		if result != bucket.TransferOk {
+			f.logger.Warn("Transfer failed, to be retried at the next listing", zap.String("key", r.S3.Object.Key))
+		}
+	}
+}
+
+func (f *Inflight) release(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, k := range f.keys {
+		if k.key == key {
+			f.keys = append(f.keys[:i], f.keys[i+1:]...)
+			f.metricPending.Dec()
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Inflight) PendingSize() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.keys)
+}
+
+func (f *Inflight) Pending() []bucket.PendingAck {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pending := make([]bucket.PendingAck, 0, len(f.keys))
+	for _, k := range f.keys {
+		pending = append(pending, bucket.PendingAck{
+			Source:   "listing",
+			Keys:     []string{k.key},
+			Received: k.received,
+		})
+	}
+	return pending
+}
+
+// NewPolling lists the bucket every Interval until ctx is cancelled, emitting objects that are old enough and not in flight
+func NewPolling(ctx context.Context, config *PollingConfig) *bucket.InboxWatcher {
+	logger := config.Logger
+	if config.Interval == 0 {
+		config.Interval = intervalDefault
+	}
+	if config.MinAge == 0 {
+		config.MinAge = minAgeDefault
+	}
+	inflight := NewInflight(logger, bucket.Registered(prometheus.NewGauge(bucket.PendingGaugeOpts)))
+	metricPolls := bucket.Registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blobs_watch_polls",
+		Help: "Inbox listings by the polling watcher, by result ok or error",
+	}, []string{"result"}))
+	metricTooRecent := bucket.Registered(prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "blobs_watch_poll_too_recent",
+		Help: "Listed objects skipped because they were modified less than MinAge ago",
+	}))
+
+	var contact bucket.Contact
+	logger.Info("Polling watcher started",
+		zap.String("bucket", config.Bucket),
+		zap.Duration("interval", config.Interval),
+		zap.Duration("minAge", config.MinAge),
+	)
+
+	// poll is false when ctx is done
+	poll := func(ch chan<- notification.Info) bool {
+		// stops the listing if we return early
+		listCtx, cancelList := context.WithCancel(ctx)
+		defer cancelList()
+		objects := config.Client.ListObjects(listCtx, config.Bucket, minio.ListObjectsOptions{Recursive: true})
+		emitted := 0
+		for object := range objects {
+			if ctx.Err() != nil {
+				return false
+			}
+			if object.Err != nil {
+				logger.Error("Polling list error, to be retried", zap.Error(object.Err))
+				metricPolls.With(prometheus.Labels{"result": "error"}).Inc()
+				return true
+			}
+			// each object is from a page the server listed, so a long listing isn't silence
+			contact.Seen()
+			if time.Since(object.LastModified) < config.MinAge {
+				metricTooRecent.Inc()
+				continue
+			}
+			if config.Skip != nil && config.Skip(object) {
+				continue
+			}
+			if !inflight.Expect(object.Key) {
+				continue
+			}
+			emitted++
+			select {
+			case ch <- NewInfo(config.Bucket, object):
+			case <-ctx.Done():
+				inflight.release(object.Key)
+				return false
+			}
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		contact.Seen()
+		metricPolls.With(prometheus.Labels{"result": "ok"}).Inc()
+		logger.Debug("Polled inbox", zap.Int("emitted", emitted), zap.Int("inflight", inflight.PendingSize()))
+		return true
+	}
+
+	ch := make(chan notification.Info)
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		for poll(ch) {
+			select {
+			case <-ctx.Done():
+			case <-ticker.C:
+			}
+		}
+		logger.Info("Polling watcher stopped")
+	}()
+
+	return &bucket.InboxWatcher{
+		Uploads:  ch,
+		Ack:      inflight.Ack,
+		Pending:  inflight.Pending,
+		LastSeen: contact.LastSeen,
+	}
+}
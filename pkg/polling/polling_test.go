@@ -0,0 +1,116 @@
+package polling_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap/zaptest"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+	"repos.se/minio-deduplication/v2/pkg/polling"
+	"repos.se/minio-deduplication/v2/pkg/sequencer"
+)
+
+func TestNewInfo(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	info := polling.NewInfo("bucket.write", minio.ObjectInfo{Key: "dir/a b.txt", Size: 3, ETag: "e", LastModified: modified})
+	if len(info.Records) != 1 {
+		t.Fatalf("Expected one record, got %d", len(info.Records))
+	}
+	r := info.Records[0]
+	if r.S3.Bucket.Name != "bucket.write" || r.S3.Object.Key != "dir/a b.txt" || r.S3.Object.Size != 3 {
+		t.Errorf("Unexpected record %v", r)
+	}
+	if r.EventTime != "2024-01-02T03:04:05.000000006Z" {
+		t.Errorf("Expected event time from last modified, got %s", r.EventTime)
+	}
+	if sequencer.Id(r) != "" {
+		t.Error("Synthetic records should have no sequencer, as a key may be uploaded again with the same content")
+	}
+}
+
+func TestInflight(t *testing.T) {
+	pending := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_pending"})
+	inflight := polling.NewInflight(zaptest.NewLogger(t), pending)
+
+	a := polling.NewInfo("bucket.write", minio.ObjectInfo{Key: "a.txt"})
+	b := polling.NewInfo("bucket.write", minio.ObjectInfo{Key: "b.txt"})
+	if !inflight.Expect("a.txt") || !inflight.Expect("b.txt") {
+		t.Error("Expected new keys to be emitted")
+	}
+	if inflight.Expect("a.txt") {
+		t.Error("Expected a key in flight to be skipped by the next listing")
+	}
+	if len(inflight.Pending()) != 2 || testutil.ToFloat64(pending) != 2 {
+		t.Errorf("Unexpected pending %v", inflight.Pending())
+	}
+
+	inflight.Ack(context.TODO(), bucket.TransferOk, &a)
+	inflight.Ack(context.TODO(), bucket.TransferFailed, &b)
+	inflight.Ack(context.TODO(), bucket.TransferOk, &a)
+	if inflight.PendingSize() != 0 || testutil.ToFloat64(pending) != 0 {
+		t.Errorf("Expected nothing in flight, got %v", inflight.Pending())
+	}
+	if !inflight.Expect("b.txt") {
+		t.Error("Expected a failed key to be emitted again by the next listing")
+	}
+}
+
+func TestPollingContactDuringListing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><IsTruncated>false</IsTruncated>`+
+			`<Contents><Key>a.txt</Key><LastModified>2020-01-01T00:00:00.000Z</LastModified><Size>1</Size></Contents>`+
+			`<Contents><Key>b.txt</Key><LastModified>2020-01-01T00:00:00.000Z</LastModified><Size>1</Size></Contents>`+
+			`</ListBucketResult>`)
+	}))
+	defer server.Close()
+	client, err := minio.New(server.Listener.Addr().String(), &minio.Options{
+		Creds:  credentials.NewStaticV4("a", "b", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	watcher := polling.NewPolling(ctx, &polling.PollingConfig{
+		Logger: zaptest.NewLogger(t),
+		Client: client,
+		Bucket: "bucket.write",
+	})
+	<-watcher.Uploads
+	// the listing waits for us to take b.txt, which is a backlog that isn't silence
+	if watcher.LastSeen().IsZero() {
+		t.Error("Expected contact before the listing completes")
+	}
+	cancel()
+	for range watcher.Uploads {
+	}
+}
+
+func TestNewPollingRerun(t *testing.T) {
+	client, err := minio.New("127.0.0.1:1", &minio.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// like mainMinio's re-runs, which create a watcher per run with the same metrics
+	for run := 0; run < 2; run++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		watcher := polling.NewPolling(ctx, &polling.PollingConfig{
+			Logger: zaptest.NewLogger(t),
+			Client: client,
+			Bucket: "bucket.write",
+		})
+		for range watcher.Uploads {
+			t.Error("Expected no uploads after ctx is done")
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+	"repos.se/minio-deduplication/v2/pkg/index"
+	"repos.se/minio-deduplication/v2/pkg/metadata"
+)
+
+var sha256hex = regexp.MustCompile("^[0-9a-f]{64}$")
+
+type Blob struct {
+	Sha256      string            `json:"sha256"`
+	Key         string            `json:"key"`
+	Size        int64             `json:"size"`
+	Etag        string            `json:"etag"`
+	ContentType string            `json:"contentType"`
+	Meta        map[string]string `json:"meta"`
+	Uploads     []string          `json:"uploads"`
+}
+
+// BlobLookup returns nil without error if the blob doesn't exist
+type BlobLookup func(ctx context.Context, sha256 string) (*Blob, error)
+
+// UploadResolver maps an upload path to its latest index entry, with the blob key it was archived as, nil without error if it's not indexed
+type UploadResolver func(ctx context.Context, upload string) (*index.IndexEntry, error)
+
+// BlobDir is the archive prefix for a checksum
+func BlobDir(sha256 string) string {
+	return sha256[0:2] + "/" + sha256[2:4] + "/"
+}
+
+// BlobSha256 extracts the checksum from an archive key
+func BlobSha256(key string) string {
+	name := path.Base(key)
+	if len(name) < 64 {
+		return ""
+	}
+	return name[0:64]
+}
+
+// NewMinioLookup finds blobs by listing the checksum's prefix, because the key has the upload's extension
+func NewMinioLookup(client *minio.Client, bucket string) BlobLookup {
+	return func(ctx context.Context, sha256 string) (*Blob, error) {
+		listctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		key := ""
+		for object := range client.ListObjects(listctx, bucket, minio.ListObjectsOptions{
+			Prefix: BlobDir(sha256) + sha256,
+		}) {
+			if object.Err != nil {
+				return nil, object.Err
+			}
+			key = object.Key
+			break
+		}
+		if key == "" {
+			return nil, nil
+		}
+		info, err := client.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+		if err != nil {
+			if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return &Blob{
+			Sha256:      sha256,
+			Key:         info.Key,
+			Size:        info.Size,
+			Etag:        info.ETag,
+			ContentType: info.ContentType,
+			Meta:        info.UserMetadata,
+			Uploads:     metadata.SplitPaths(info.UserMetadata["Uploadpaths"]),
+		}, nil
+	}
+}
+
+type cached struct {
+	blob    *Blob
+	expires time.Time
+}
+
+// NewCachedLookup caches found blobs for ttl; uploadpaths grow on duplicates so ttl should be short
+func NewCachedLookup(lookup BlobLookup, ttl time.Duration, maxEntries int) BlobLookup {
+	var mu sync.Mutex
+	cache := make(map[string]cached)
+	return func(ctx context.Context, sha256 string) (*Blob, error) {
+		now := time.Now()
+		mu.Lock()
+		c, hit := cache[sha256]
+		mu.Unlock()
+		if hit && now.Before(c.expires) {
+			return c.blob, nil
+		}
+		blob, err := lookup(ctx, sha256)
+		if err != nil || blob == nil {
+			return blob, err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(cache) >= maxEntries {
+			for k, v := range cache {
+				if now.After(v.expires) {
+					delete(cache, k)
+				}
+			}
+		}
+		if len(cache) < maxEntries {
+			cache[sha256] = cached{blob: blob, expires: now.Add(ttl)}
+		}
+		return blob, nil
+	}
+}
+
+// NewIndexResolver looks up uploads first in recent, the index that isn't written yet,
+// then in the index objects written under prefix, newest first; client nil means there are none
+func NewIndexResolver(recent func(upload string) (index.IndexEntry, bool), client *minio.Client, bucket, prefix string) UploadResolver {
+	return func(ctx context.Context, upload string) (*index.IndexEntry, error) {
+		if entry, found := recent(upload); found {
+			return &entry, nil
+		}
+		if client == nil {
+			return nil, nil
+		}
+		listctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		var keys []string
+		for object := range client.ListObjects(listctx, bucket, minio.ListObjectsOptions{Prefix: prefix + "/"}) {
+			if object.Err != nil {
+				return nil, object.Err
+			}
+			keys = append(keys, object.Key)
+		}
+		// index keys are timestamps
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+		for _, key := range keys {
+			object, err := client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+			if err != nil {
+				return nil, err
+			}
+			entry, err := index.Find(object, upload)
+			object.Close()
+			if err != nil || entry != nil {
+				return entry, err
+			}
+		}
+		return nil, nil
+	}
+}
+
+type cachedEntry struct {
+	entry   *index.IndexEntry
+	expires time.Time
+}
+
+// NewCachedResolver caches entries, and that uploads aren't indexed, for ttl; a newer entry is found after ttl
+func NewCachedResolver(resolve UploadResolver, ttl time.Duration, maxEntries int) UploadResolver {
+	var mu sync.Mutex
+	cache := make(map[string]cachedEntry)
+	return func(ctx context.Context, upload string) (*index.IndexEntry, error) {
+		now := time.Now()
+		mu.Lock()
+		c, hit := cache[upload]
+		mu.Unlock()
+		if hit && now.Before(c.expires) {
+			return c.entry, nil
+		}
+		entry, err := resolve(ctx, upload)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(cache) >= maxEntries {
+			for k, v := range cache {
+				if now.After(v.expires) {
+					delete(cache, k)
+				}
+			}
+		}
+		if len(cache) < maxEntries {
+			cache[upload] = cachedEntry{entry: entry, expires: now.Add(ttl)}
+		}
+		return entry, nil
+	}
+}
+
+type Query struct {
+	logger  *zap.Logger
+	lookup  BlobLookup
+	resolve UploadResolver
+}
+
+func New(logger *zap.Logger, lookup BlobLookup, resolve UploadResolver) *Query {
+	return &Query{
+		logger:  logger,
+		lookup:  lookup,
+		resolve: resolve,
+	}
+}
+
+func (q *Query) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /blobs/{sha256}", q.getBlob)
+	mux.HandleFunc("HEAD /blobs/{sha256}", q.headBlob)
+	mux.HandleFunc("GET /resolve", q.getResolve)
+}
+
+func (q *Query) find(w http.ResponseWriter, r *http.Request, sha256 string) *Blob {
+	if !sha256hex.MatchString(sha256) {
+		http.Error(w, "expected a lowercase hex sha256", http.StatusBadRequest)
+		return nil
+	}
+	blob, err := q.lookup(r.Context(), sha256)
+	if err != nil {
+		q.logger.Error("Blob lookup failed", zap.String("sha256", sha256), zap.Error(err))
+		http.Error(w, "lookup failed", http.StatusBadGateway)
+		return nil
+	}
+	if blob == nil {
+		http.Error(w, "blob not found", http.StatusNotFound)
+	}
+	return blob
+}
+
+func (q *Query) respond(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		q.logger.Warn("Failed to write query response", zap.Error(err))
+	}
+}
+
+func (q *Query) getBlob(w http.ResponseWriter, r *http.Request) {
+	if blob := q.find(w, r, r.PathValue("sha256")); blob != nil {
+		q.respond(w, blob)
+	}
+}
+
+func (q *Query) headBlob(w http.ResponseWriter, r *http.Request) {
+	sha256 := r.PathValue("sha256")
+	if !sha256hex.MatchString(sha256) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	blob, err := q.lookup(r.Context(), sha256)
+	if err != nil {
+		q.logger.Error("Blob lookup failed", zap.String("sha256", sha256), zap.Error(err))
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if blob == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("ETag", blob.Etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (q *Query) getResolve(w http.ResponseWriter, r *http.Request) {
+	upload := r.URL.Query().Get("path")
+	if upload == "" {
+		http.Error(w, "path query parameter required", http.StatusBadRequest)
+		return
+	}
+	entry, err := q.resolve(r.Context(), upload)
+	if err != nil {
+		q.logger.Error("Index lookup failed", zap.String("upload", upload), zap.Error(err))
+		http.Error(w, "index lookup failed", http.StatusBadGateway)
+		return
+	}
+	if entry == nil {
+		http.Error(w, "upload path not in index", http.StatusNotFound)
+		return
+	}
+	if entry.Kind == index.KindQuarantined {
+		http.Error(w, "quarantined: "+entry.Reason, http.StatusGone)
+		return
+	}
+	if entry.Key == "" {
+		message := "upload was dropped"
+		if entry.Reason != "" {
+			message += ": " + entry.Reason
+		}
+		http.Error(w, message, http.StatusGone)
+		return
+	}
+	if blob := q.find(w, r, BlobSha256(entry.Key)); blob != nil {
+		q.respond(w, blob)
+	}
+}
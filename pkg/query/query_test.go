@@ -0,0 +1,162 @@
+package query_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.uber.org/zap/zaptest"
+	"repos.se/minio-deduplication/v2/pkg/index"
+	"repos.se/minio-deduplication/v2/pkg/query"
+)
+
+const (
+	sha = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	key = "e3/b0/e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855.txt"
+)
+
+func TestBlobSha256(t *testing.T) {
+	if query.BlobSha256(key) != sha {
+		t.Errorf("Unexpected %s", query.BlobSha256(key))
+	}
+	if query.BlobSha256("e3/b0/short.txt") != "" {
+		t.Error("Expected empty checksum for unexpected key")
+	}
+	if query.BlobDir(sha) != "e3/b0/" {
+		t.Errorf("Unexpected %s", query.BlobDir(sha))
+	}
+}
+
+func TestQuery(t *testing.T) {
+	lookups := 0
+	lookup := query.NewCachedLookup(func(ctx context.Context, sha256 string) (*query.Blob, error) {
+		lookups++
+		if sha256 != sha {
+			return nil, nil
+		}
+		return &query.Blob{Sha256: sha, Key: key, Etag: "abc", Uploads: []string{"dir/empty.txt"}}, nil
+	}, time.Minute, 10)
+	recent := func(upload string) (index.IndexEntry, bool) {
+		switch upload {
+		case "dir/empty.txt":
+			return index.IndexEntry{Upload: upload, Key: key}, true
+		case "dropped.txt":
+			return index.IndexEntry{Upload: upload}, true
+		case "infected.txt":
+			return index.IndexEntry{Upload: upload, Kind: index.KindQuarantined, Reason: "infected Eicar-Test-Signature"}, true
+		}
+		return index.IndexEntry{}, false
+	}
+	resolve := query.NewIndexResolver(recent, nil, "", "")
+	mux := http.NewServeMux()
+	query.New(zaptest.NewLogger(t), lookup, resolve).Register(mux)
+
+	get := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	w := get("GET", "/blobs/"+sha)
+	if w.Code != 200 {
+		t.Fatalf("Unexpected status %d", w.Code)
+	}
+	var blob query.Blob
+	if err := json.Unmarshal(w.Body.Bytes(), &blob); err != nil {
+		t.Fatal(err)
+	}
+	if blob.Key != key || len(blob.Uploads) != 1 {
+		t.Errorf("Unexpected blob %v", blob)
+	}
+
+	if w := get("HEAD", "/blobs/"+sha); w.Code != 200 || w.Header().Get("ETag") != "abc" {
+		t.Errorf("Unexpected HEAD %d %v", w.Code, w.Header())
+	}
+	if lookups != 1 {
+		t.Errorf("Expected cached lookup, got %d lookups", lookups)
+	}
+	if w := get("HEAD", "/blobs/"+sha[1:]+"0"); w.Code != 404 {
+		t.Errorf("Unexpected HEAD for missing blob %d", w.Code)
+	}
+	if w := get("GET", "/blobs/NOTHEX"); w.Code != 400 {
+		t.Errorf("Unexpected status for invalid checksum %d", w.Code)
+	}
+
+	if w := get("GET", "/resolve?path=dir%2Fempty.txt"); w.Code != 200 {
+		t.Errorf("Unexpected resolve status %d", w.Code)
+	}
+	if w := get("GET", "/resolve?path=dropped.txt"); w.Code != 410 || w.Body.String() != "upload was dropped\n" {
+		t.Errorf("Unexpected resolve for dropped %d %s", w.Code, w.Body.String())
+	}
+	if w := get("GET", "/resolve?path=infected.txt"); w.Code != 410 || w.Body.String() != "quarantined: infected Eicar-Test-Signature\n" {
+		t.Errorf("Unexpected resolve for quarantined %d %s", w.Code, w.Body.String())
+	}
+	if w := get("GET", "/resolve?path=other.txt"); w.Code != 404 {
+		t.Errorf("Unexpected resolve status for unknown %d", w.Code)
+	}
+	if w := get("GET", "/resolve"); w.Code != 400 {
+		t.Errorf("Unexpected resolve status without path %d", w.Code)
+	}
+}
+
+func TestIndexResolverWritten(t *testing.T) {
+	written := map[string]string{
+		"deduplication-index/2024-01-01t000000.jsonlines":     `{"v":1,"upload":"a.txt","key":"old.txt"}` + "\n" + `{"v":1,"upload":"b.txt","key":"b.txt"}` + "\n",
+		"deduplication-index/2024-01-02t000000.000.jsonlines": `{"v":1,"upload":"a.txt","key":"new.txt"}` + "\n",
+	}
+	gets := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("list-type") == "2" {
+			w.Write([]byte(`<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><IsTruncated>false</IsTruncated>`))
+			for key := range written {
+				fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", key)
+			}
+			w.Write([]byte(`</ListBucketResult>`))
+			return
+		}
+		body, found := written[strings.TrimPrefix(r.URL.Path, "/bucket.read/")]
+		if !found {
+			t.Errorf("Unexpected S3 request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		gets++
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	client, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("a", "b", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recent := func(upload string) (index.IndexEntry, bool) {
+		return index.IndexEntry{Upload: upload, Key: "recent.txt"}, upload == "c.txt"
+	}
+	resolve := query.NewCachedResolver(query.NewIndexResolver(recent, client, "bucket.read", "deduplication-index"), time.Minute, 10)
+
+	for upload, expected := range map[string]string{"a.txt": "new.txt", "b.txt": "b.txt", "c.txt": "recent.txt"} {
+		entry, err := resolve(context.Background(), upload)
+		if err != nil || entry == nil || entry.Key != expected {
+			t.Errorf("Expected %s to resolve to %s, got %v %v", upload, expected, entry, err)
+		}
+	}
+	if entry, err := resolve(context.Background(), "other.txt"); err != nil || entry != nil {
+		t.Errorf("Expected other.txt not to be indexed, got %v %v", entry, err)
+	}
+	before := gets
+	resolve(context.Background(), "other.txt")
+	if gets != before {
+		t.Error("Expected a cached miss")
+	}
+}
@@ -0,0 +1,76 @@
+package redis_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap/zaptest"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+	"repos.se/minio-deduplication/v2/pkg/redis"
+)
+
+func TestAcks(t *testing.T) {
+
+	ctx := context.TODO()
+	pending := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_pending"})
+	actions := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_acks"}, []string{"action"})
+	var acked []string
+	acks := redis.NewRedisAcks(zaptest.NewLogger(t), "minio", func(_ context.Context, ids ...string) error {
+		acked = append(acked, ids...)
+		return nil
+	}, pending, actions)
+
+	newInfo := func(sequencer string) notification.Info {
+		info := notification.Info{Records: make([]notification.Event, 1)}
+		info.Records[0].S3.Object.Key = "file.txt"
+		info.Records[0].S3.Object.Sequencer = sequencer
+		return info
+	}
+	ok, failed := newInfo("s1"), newInfo("s2")
+	if !acks.Expect("1-0", &ok) || !acks.Expect("2-0", &failed) {
+		t.Error("Expected new entries to be accepted")
+	}
+	claimed := newInfo("s3")
+	if acks.Expect("2-0", &claimed) {
+		t.Error("An entry that is already in progress should not be emitted again when claimed")
+	}
+	if len(acks.Pending()) != 2 || acks.Pending()[1].Source != "minio@2-0" {
+		t.Errorf("Unexpected pending %v", acks.Pending())
+	}
+
+	// copies, like those that went through the channel, acked out of order
+	failedCopy := failed
+	acks.Ack(ctx, bucket.TransferFailed, &failedCopy)
+	okCopy := ok
+	acks.Ack(ctx, bucket.TransferOk, &okCopy)
+	acks.Ack(ctx, bucket.TransferOk, &okCopy)
+
+	if len(acked) != 1 || acked[0] != "1-0" {
+		t.Errorf("Expected only 1-0 to be acked, failed transfers stay pending for claim, got %v", acked)
+	}
+	if acks.PendingSize() != 0 || testutil.ToFloat64(pending) != 0 {
+		t.Errorf("Expected nothing pending, got %d", acks.PendingSize())
+	}
+	if testutil.ToFloat64(actions.WithLabelValues("retry")) != 1 {
+		t.Error("Expected the retry to be counted")
+	}
+
+	acks.Done(ctx, "3-0", "drop")
+	if len(acked) != 2 || acked[1] != "3-0" || testutil.ToFloat64(actions.WithLabelValues("drop")) != 1 {
+		t.Errorf("Expected dropped entries to be acked and counted, got %v", acked)
+	}
+
+	// a forgotten entry isn't acked, and can be claimed again
+	abandoned := newInfo("")
+	acks.Expect("4-0", &abandoned)
+	acks.Forget(&abandoned)
+	if len(acked) != 2 || acks.PendingSize() != 0 {
+		t.Errorf("Expected the forgotten entry to stay unacked and untracked, got %v", acked)
+	}
+	if !acks.Expect("4-0", &abandoned) {
+		t.Error("Expected a forgotten entry to be accepted when claimed")
+	}
+}
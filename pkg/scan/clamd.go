@@ -0,0 +1,278 @@
+package scan
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	timeoutDefault   = time.Duration(time.Minute * 1)
+	chunkSizeDefault = 64 * 1024
+	// versionTtl is how long a database version is reused, as freshclam updates it in the background
+	versionTtl = time.Duration(time.Minute * 1)
+)
+
+// ErrSizeLimit is clamd refusing a stream longer than its StreamMaxLength, so the upload is not scanned
+var ErrSizeLimit = errors.New("clamd stream size limit exceeded")
+
+type ClamdConfig struct {
+	Logger *zap.Logger
+	// Address is tcp://host:port, unix:///path/to/clamd.sock or host:port
+	Address string
+	// Timeout is per network operation, so that a stalled clamd fails the transfer, zero for default
+	Timeout time.Duration
+	// ChunkSize is zero for default, and must not exceed clamd's StreamMaxLength
+	ChunkSize int
+	// Registerer defaults to the prometheus default registry
+	Registerer prometheus.Registerer
+}
+
+// Result is a completed scan, where Database is clamd's version and signature database version
+type Result struct {
+	Infected  bool
+	Signature string
+	Database  string
+}
+
+// Metadata is what's recorded with the blob, or with the quarantined upload
+func (r Result) Metadata() map[string]string {
+	result := "clean"
+	if r.Infected {
+		result = "infected " + r.Signature
+	}
+	return map[string]string{
+		"Scan-Result":   result,
+		"Scan-Database": r.Database,
+	}
+}
+
+// Clamd scans uploads using clamd's INSTREAM command, one connection per scan
+type Clamd struct {
+	config    *ClamdConfig
+	logger    *zap.Logger
+	network   string
+	address   string
+	mu        sync.Mutex
+	version   string
+	versionAt time.Time
+	results   *prometheus.CounterVec
+	duration  prometheus.Histogram
+	bytes     prometheus.Counter
+}
+
+func NewClamd(config *ClamdConfig) (*Clamd, error) {
+	if config.Timeout == 0 {
+		config.Timeout = timeoutDefault
+	}
+	if config.ChunkSize == 0 {
+		config.ChunkSize = chunkSizeDefault
+	}
+	if config.Registerer == nil {
+		config.Registerer = prometheus.DefaultRegisterer
+	}
+	network, address := "tcp", config.Address
+	if path, found := strings.CutPrefix(address, "unix://"); found {
+		network, address = "unix", path
+	} else {
+		address = strings.TrimPrefix(address, "tcp://")
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("clamd address %q: %w", config.Address, err)
+		}
+	}
+	if address == "" {
+		return nil, fmt.Errorf("clamd address %q is empty", config.Address)
+	}
+	factory := promauto.With(config.Registerer)
+	return &Clamd{
+		config:  config,
+		logger:  config.Logger,
+		network: network,
+		address: address,
+		results: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "blobs_scan_results",
+			Help: "Completed and failed scans, by result clean, infected, sizelimit or error",
+		}, []string{"result"}),
+		duration: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "blobs_scan_duration_seconds",
+			Help:    "Time from the start of a scan stream to clamd's reply",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+		}),
+		bytes: factory.NewCounter(prometheus.CounterOpts{
+			Name: "blobs_scan_bytes",
+			Help: "Bytes streamed to clamd",
+		}),
+	}, nil
+}
+
+func (c *Clamd) dial(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: c.config.Timeout}
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, fmt.Errorf("clamd connect: %w", err)
+	}
+	return conn, nil
+}
+
+// command sends a null terminated command and returns the reply without its terminator
+func (c *Clamd) command(ctx context.Context, name string) (string, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	if _, err := conn.Write([]byte("z" + name + "\x00")); err != nil {
+		return "", fmt.Errorf("clamd %s: %w", name, err)
+	}
+	return readReply(conn)
+}
+
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", fmt.Errorf("clamd reply: %w", err)
+	}
+	return strings.TrimSuffix(reply, "\x00"), nil
+}
+
+// Version is clamd's reply to VERSION, such as ClamAV 1.4.1/27432/Mon Oct 14 08:36:01 2024, cached briefly.
+// The lock isn't held during the command, so that a slow clamd doesn't serialize scans, and concurrent refreshes may overlap.
+func (c *Clamd) Version(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	cached, at := c.version, c.versionAt
+	c.mu.Unlock()
+	if cached != "" && time.Since(at) < versionTtl {
+		return cached, nil
+	}
+	version, err := c.command(ctx, "VERSION")
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	previous := c.version
+	c.version, c.versionAt = version, time.Now()
+	c.mu.Unlock()
+	if version != previous {
+		c.logger.Info("Clamd version", zap.String("version", version))
+	}
+	return version, nil
+}
+
+// Stream starts a scan, which the caller must complete with Result or abort with Close
+func (c *Clamd) Stream(ctx context.Context) (*Stream, error) {
+	database, err := c.Version(ctx)
+	if err != nil {
+		c.results.With(prometheus.Labels{"result": "error"}).Inc()
+		return nil, err
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		c.results.With(prometheus.Labels{"result": "error"}).Inc()
+		return nil, err
+	}
+	s := &Stream{clamd: c, conn: conn, database: database, started: time.Now()}
+	s.send([]byte("zINSTREAM\x00"))
+	return s, nil
+}
+
+// Stream is an io.Writer that sends INSTREAM chunks.
+// Write doesn't fail, so that hashing can complete in the same pass, and errors are returned by Result.
+type Stream struct {
+	clamd    *Clamd
+	conn     net.Conn
+	database string
+	started  time.Time
+	err      error
+	done     bool
+}
+
+func (s *Stream) send(b []byte) {
+	if s.err != nil {
+		return
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.clamd.config.Timeout))
+	if _, err := s.conn.Write(b); err != nil {
+		s.err = err
+	}
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	size := make([]byte, 4)
+	for chunk := p; len(chunk) > 0 && s.err == nil; {
+		n := min(len(chunk), s.clamd.config.ChunkSize)
+		binary.BigEndian.PutUint32(size, uint32(n))
+		s.send(size)
+		s.send(chunk[:n])
+		chunk = chunk[n:]
+	}
+	if s.err == nil {
+		s.clamd.bytes.Add(float64(len(p)))
+	}
+	return len(p), nil
+}
+
+// Result ends the stream and returns clamd's verdict
+func (s *Stream) Result() (Result, error) {
+	defer s.Close()
+	result, err := s.result()
+	label := "clean"
+	switch {
+	case errors.Is(err, ErrSizeLimit):
+		label = "sizelimit"
+	case err != nil:
+		label = "error"
+	case result.Infected:
+		label = "infected"
+	}
+	s.clamd.results.With(prometheus.Labels{"result": label}).Inc()
+	if err == nil {
+		s.clamd.duration.Observe(time.Since(s.started).Seconds())
+	}
+	return result, err
+}
+
+func (s *Stream) result() (Result, error) {
+	s.send([]byte{0, 0, 0, 0})
+	// clamd replies and closes the connection when the size limit is exceeded, so a write error may have a reply
+	s.conn.SetReadDeadline(time.Now().Add(s.clamd.config.Timeout))
+	reply, err := readReply(s.conn)
+	if err != nil {
+		if s.err != nil {
+			return Result{}, fmt.Errorf("clamd stream: %w", s.err)
+		}
+		return Result{}, err
+	}
+	result := Result{Database: s.database}
+	verdict := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case verdict == "OK":
+		return result, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		result.Infected = true
+		result.Signature = strings.TrimSuffix(verdict, " FOUND")
+		return result, nil
+	case strings.HasPrefix(reply, "INSTREAM size limit exceeded"):
+		return Result{}, ErrSizeLimit
+	}
+	return Result{}, fmt.Errorf("clamd: %s", reply)
+}
+
+// Close aborts the scan if Result wasn't called
+func (s *Stream) Close() error {
+	if s.done {
+		return nil
+	}
+	s.done = true
+	return s.conn.Close()
+}
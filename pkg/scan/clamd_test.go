@@ -0,0 +1,170 @@
+package scan_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap/zaptest"
+	"repos.se/minio-deduplication/v2/pkg/scan"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd implements VERSION and INSTREAM, and like clamd it closes the connection at the size limit
+func fakeClamd(t *testing.T, network, address string, limit int) string {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		command, err := r.ReadString(0)
+		if err != nil {
+			return
+		}
+		switch command {
+		case "zVERSION\x00":
+			conn.Write([]byte("ClamAV 1.4.1/27432/Mon Oct 14 08:36:01 2024\x00"))
+			return
+		case "zINSTREAM\x00":
+		default:
+			conn.Write([]byte("UNKNOWN COMMAND\x00"))
+			return
+		}
+		var received bytes.Buffer
+		for {
+			var size uint32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			if received.Len()+int(size) > limit {
+				conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+				return
+			}
+			if _, err := io.CopyN(&received, r, int64(size)); err != nil {
+				return
+			}
+		}
+		if strings.Contains(received.String(), eicar) {
+			conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			return
+		}
+		conn.Write([]byte("stream: OK\x00"))
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func scanned(t *testing.T, clamd *scan.Clamd, content []byte) (scan.Result, error) {
+	stream, err := clamd.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// like io.Copy from the object, in small writes
+	if _, err := io.CopyBuffer(stream, bytes.NewReader(content), make([]byte, 7)); err != nil {
+		t.Fatal(err)
+	}
+	return stream.Result()
+}
+
+func TestClamd(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	clamd, err := scan.NewClamd(&scan.ClamdConfig{
+		Logger:     zaptest.NewLogger(t),
+		Address:    "tcp://" + fakeClamd(t, "tcp", "127.0.0.1:0", 1024),
+		ChunkSize:  5,
+		Registerer: registry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := scanned(t, clamd, []byte("a clean upload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Infected || result.Database != "ClamAV 1.4.1/27432/Mon Oct 14 08:36:01 2024" {
+		t.Errorf("Unexpected result %v", result)
+	}
+	if result.Metadata()["Scan-Result"] != "clean" {
+		t.Errorf("Unexpected metadata %v", result.Metadata())
+	}
+
+	result, err = scanned(t, clamd, []byte(eicar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Infected || result.Signature != "Eicar-Test-Signature" {
+		t.Errorf("Expected the signature found in chunks, got %v", result)
+	}
+	if result.Metadata()["Scan-Result"] != "infected Eicar-Test-Signature" {
+		t.Errorf("Unexpected metadata %v", result.Metadata())
+	}
+
+	_, err = scanned(t, clamd, bytes.Repeat([]byte("a"), 1024*1024))
+	if !errors.Is(err, scan.ErrSizeLimit) {
+		t.Errorf("Expected the size limit, got %v", err)
+	}
+
+	if count := testutil.CollectAndCount(registry, "blobs_scan_results"); count != 3 {
+		t.Errorf("Expected a count per result, got %d", count)
+	}
+}
+
+func TestClamdUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "clamd.sock")
+	fakeClamd(t, "unix", socket, 1024)
+	clamd, err := scan.NewClamd(&scan.ClamdConfig{
+		Logger:     zaptest.NewLogger(t),
+		Address:    "unix://" + socket,
+		Registerer: prometheus.NewRegistry(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := scanned(t, clamd, []byte(eicar)); err != nil || !result.Infected {
+		t.Errorf("Unexpected %v %v", result, err)
+	}
+}
+
+func TestClamdAddress(t *testing.T) {
+	for _, invalid := range []string{"", "clamd", "unix://"} {
+		if _, err := scan.NewClamd(&scan.ClamdConfig{Address: invalid, Registerer: prometheus.NewRegistry()}); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+	clamd, err := scan.NewClamd(&scan.ClamdConfig{
+		Logger:     zaptest.NewLogger(t),
+		Address:    "127.0.0.1:1",
+		Registerer: prometheus.NewRegistry(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clamd.Stream(context.Background()); err == nil {
+		t.Error("Expected a connection error")
+	}
+}
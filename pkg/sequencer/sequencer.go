@@ -0,0 +1,164 @@
+package sequencer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+)
+
+// Id is the key and S3 Sequencer, unique per upload per https://github.com/minio/minio/blob/RELEASE.2023-01-06T18-11-18Z/cmd/event-notification.go#L289
+// Empty if the event has no sequencer.
+func Id(event notification.Event) string {
+	if event.S3.Object.Sequencer == "" {
+		return ""
+	}
+	return event.S3.Object.Key + "@" + event.S3.Object.Sequencer
+}
+
+// Cache remembers the most recent completed ids, up to a max, to detect redelivery
+type Cache struct {
+	mu    sync.Mutex
+	max   int
+	ids   map[string]struct{}
+	order []string
+	// file is nil unless persisted, appended to and compacted when it grows past twice max
+	path     string
+	file     *os.File
+	appended int
+}
+
+func New(max int) *Cache {
+	return &Cache{
+		max:   max,
+		ids:   make(map[string]struct{}, max),
+		order: make([]string, 0, max),
+	}
+}
+
+// Open loads the most recent ids from path if it exists, and persists additions to it
+func Open(path string, max int) (*Cache, error) {
+	c := New(max)
+	c.path = path
+	existing, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(existing)
+		for scanner.Scan() {
+			if id := scanner.Text(); id != "" {
+				c.add(id)
+			}
+		}
+		existing.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := c.compact(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Seen is true if the id was added and hasn't been evicted, always false for empty ids
+func (c *Cache) Seen(id string) bool {
+	if id == "" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, found := c.ids[id]
+	return found
+}
+
+// Add remembers an id, evicting the oldest at max size, and is a no-op for empty ids or max zero
+func (c *Cache) Add(id string) error {
+	if id == "" || c.max <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.ids[id]; found {
+		return nil
+	}
+	c.add(id)
+	if c.file == nil {
+		return nil
+	}
+	if _, err := fmt.Fprintln(c.file, id); err != nil {
+		return err
+	}
+	c.appended++
+	if c.appended > c.max*2 {
+		return c.compact()
+	}
+	return nil
+}
+
+func (c *Cache) Size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.order)
+}
+
+// Close stops persisting, a no-op for a memory cache
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// add must be called with mu held, or before the cache is shared
+func (c *Cache) add(id string) {
+	if c.max <= 0 {
+		return
+	}
+	if _, found := c.ids[id]; found {
+		return
+	}
+	if len(c.order) >= c.max {
+		delete(c.ids, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.ids[id] = struct{}{}
+	c.order = append(c.order, id)
+}
+
+// compact rewrites the file with the current ids, atomically, and reopens it for append
+func (c *Cache) compact() error {
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(strings.Join(c.order, "\n") + "\n"); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	c.file, err = os.OpenFile(c.path, os.O_APPEND|os.O_WRONLY, 0600)
+	c.appended = 0
+	return err
+}
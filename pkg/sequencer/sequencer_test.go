@@ -0,0 +1,91 @@
+package sequencer_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"repos.se/minio-deduplication/v2/pkg/sequencer"
+)
+
+func TestId(t *testing.T) {
+
+	var event notification.Event
+	event.S3.Object.Key = "dir/file.txt"
+	if sequencer.Id(event) != "" {
+		t.Errorf("Expected no id without sequencer, got %s", sequencer.Id(event))
+	}
+	event.S3.Object.Sequencer = "17A3B"
+	if sequencer.Id(event) != "dir/file.txt@17A3B" {
+		t.Errorf("Unexpected id %s", sequencer.Id(event))
+	}
+
+}
+
+func TestCache(t *testing.T) {
+
+	c := sequencer.New(2)
+	c.Add("a")
+	c.Add("b")
+	c.Add("a")
+	if !c.Seen("a") || !c.Seen("b") {
+		t.Error("Expected both ids within max to be seen")
+	}
+	c.Add("c")
+	if c.Seen("a") {
+		t.Error("Expected the oldest id to be evicted")
+	}
+	if c.Size() != 2 {
+		t.Errorf("Expected size to stay at max, got %d", c.Size())
+	}
+	c.Add("")
+	if c.Seen("") {
+		t.Error("Empty ids should never be seen")
+	}
+
+	disabled := sequencer.New(0)
+	disabled.Add("a")
+	if disabled.Seen("a") {
+		t.Error("Expected nothing to be remembered with max zero")
+	}
+
+}
+
+func TestCachePersisted(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "sequencers")
+	c, err := sequencer.Open(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		if err := c.Add(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines > 7 {
+		t.Errorf("Expected the file to be compacted, got %d lines", lines)
+	}
+
+	reopened, err := sequencer.Open(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.Size() != 3 {
+		t.Errorf("Expected max ids after reopen, got %d", reopened.Size())
+	}
+	if !reopened.Seen("g") || !reopened.Seen("e") || reopened.Seen("d") {
+		t.Error("Expected the most recent ids to survive a reopen")
+	}
+
+}
@@ -0,0 +1,334 @@
+package webhook
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+	"repos.se/minio-deduplication/v2/pkg/kafka"
+)
+
+// ReceiverPath is where MinIO's webhook target should post, i.e. MINIO_NOTIFY_WEBHOOK_ENDPOINT
+const ReceiverPath = "/webhook/minio"
+
+const (
+	maxBodyDefault = int64(1 << 20)
+	waitDefault    = time.Duration(time.Second * 30)
+)
+
+type ReceiverConfig struct {
+	Logger *zap.Logger
+	// Token is required, and MinIO sends it as a bearer token when configured as MINIO_NOTIFY_WEBHOOK_AUTH_TOKEN
+	Token string
+	// Filter is on the event's Key, which MinIO sets to bucket/key
+	Filter kafka.MessageFilter
+	// MaxBody and Wait are zero for defaults. Wait bounds how long a request waits for its transfer,
+	// after which MinIO retries and the transfer, if it completes, makes the retry a no-op.
+	MaxBody int64
+	Wait    time.Duration
+	// Registerer defaults to the prometheus default registry
+	Registerer prometheus.Registerer
+}
+
+type receiverPending struct {
+	info     *notification.Info
+	remote   string
+	received time.Time
+	// result is buffered so that Ack never blocks on a request that timed out
+	result chan bucket.TransferResult
+	gone   context.Context
+}
+
+// receiverRun is the Uploads of one Watcher, from its start until its ctx is done
+type receiverRun struct {
+	uploads chan notification.Info
+	stop    <-chan struct{}
+	sending sync.WaitGroup
+}
+
+// Receiver is an InboxWatcher for MinIO's webhook target, responding 2xx only when the transfer succeeded
+// so that MinIO's queue_dir retries failures.
+// Routes are registered once, and outlive watchers, so that a re-run only needs a new Watcher.
+type Receiver struct {
+	config   *ReceiverConfig
+	logger   *zap.Logger
+	filter   func(key string) bool
+	mu       sync.Mutex
+	run      *receiverRun
+	pending  []*receiverPending
+	requests *prometheus.CounterVec
+	waiting  prometheus.Gauge
+}
+
+func NewReceiver(config *ReceiverConfig) *Receiver {
+	logger := config.Logger
+	if config.Token == "" {
+		logger.Fatal("Webhook receiver requires a token")
+	}
+	if config.MaxBody == 0 {
+		config.MaxBody = maxBodyDefault
+	}
+	if config.Wait == 0 {
+		config.Wait = waitDefault
+	}
+	if config.Registerer == nil {
+		config.Registerer = prometheus.DefaultRegisterer
+	}
+	metrics := promauto.With(config.Registerer)
+	return &Receiver{
+		config: config,
+		logger: logger,
+		filter: kafka.NewKeyFilterPredicate(config.Filter, logger),
+		requests: metrics.NewCounterVec(prometheus.CounterOpts{
+			Name: "blobs_watch_webhook_requests",
+			Help: "Notification requests received, by response status",
+		}, []string{"status"}),
+		waiting: metrics.NewGauge(bucket.PendingGaugeOpts),
+	}
+}
+
+func (r *Receiver) Register(mux *http.ServeMux) {
+	// MinIO checks that the target is reachable with HEAD, which reveals nothing so it needs no token
+	mux.HandleFunc("HEAD "+ReceiverPath, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("POST "+ReceiverPath, r.auth(r.post))
+}
+
+func (r *Receiver) auth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(r.config.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			r.respond(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		handler(w, req)
+	}
+}
+
+func (r *Receiver) respond(w http.ResponseWriter, status int, message string) {
+	r.requests.With(prometheus.Labels{"status": fmt.Sprint(status)}).Inc()
+	if status >= 200 && status < 300 {
+		w.WriteHeader(status)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+// parse validates that the body is a notification we can process
+func (r *Receiver) parse(body io.Reader) (*bucket.Event, error) {
+	var event bucket.Event
+	decoder := json.NewDecoder(body)
+	if err := decoder.Decode(&event); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("trailing data after the event")
+	}
+	if event.Key == "" {
+		return nil, errors.New("no Key")
+	}
+	if len(event.Records) == 0 {
+		return nil, errors.New("zero records")
+	}
+	for i, record := range event.Records {
+		if record.S3.Bucket.Name == "" || record.S3.Object.Key == "" {
+			return nil, fmt.Errorf("record %d has no bucket or object key", i)
+		}
+	}
+	return &event, nil
+}
+
+func (r *Receiver) post(w http.ResponseWriter, req *http.Request) {
+	event, err := r.parse(http.MaxBytesReader(w, req.Body, r.config.MaxBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			r.respond(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		r.logger.Error("Invalid webhook notification", zap.String("remote", req.RemoteAddr), zap.Error(err))
+		r.respond(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !r.filter(event.Key) {
+		r.logger.Debug("Filtered out", zap.String("key", event.Key))
+		r.respond(w, http.StatusNoContent, "")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), r.config.Wait)
+	defer cancel()
+	p := &receiverPending{
+		info:     &notification.Info{Records: event.Records},
+		remote:   req.RemoteAddr,
+		received: time.Now(),
+		result:   make(chan bucket.TransferResult, 1),
+		gone:     ctx,
+	}
+	r.mu.Lock()
+	run := r.run
+	if run == nil {
+		r.mu.Unlock()
+		r.respond(w, http.StatusServiceUnavailable, "not watching")
+		return
+	}
+	run.sending.Add(1)
+	r.pending = append(r.pending, p)
+	r.mu.Unlock()
+	r.waiting.Inc()
+	defer r.remove(p)
+
+	r.logger.Info("Got notification", zap.String("eventName", event.EventName), zap.String("key", event.Key))
+	select {
+	case run.uploads <- *p.info:
+		run.sending.Done()
+	case <-run.stop:
+		run.sending.Done()
+		r.respond(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	case <-ctx.Done():
+		run.sending.Done()
+		r.respond(w, http.StatusServiceUnavailable, "busy")
+		return
+	}
+
+	select {
+	case result := <-p.result:
+		if result == bucket.TransferOk {
+			r.respond(w, http.StatusNoContent, "")
+		} else {
+			r.respond(w, http.StatusInternalServerError, "transfer failed")
+		}
+	case <-ctx.Done():
+		r.logger.Warn("Transfer still in progress at webhook response timeout", zap.String("key", event.Key))
+		r.respond(w, http.StatusGatewayTimeout, "transfer in progress")
+	}
+}
+
+// remove is a no-op if Ack already removed p
+func (r *Receiver) remove(p *receiverPending) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, q := range r.pending {
+		if q == p {
+			r.removeAt(i)
+			return
+		}
+	}
+}
+
+// removeAt must be called with mu held
+func (r *Receiver) removeAt(i int) {
+	r.pending = append(r.pending[:i], r.pending[i+1:]...)
+	r.waiting.Dec()
+}
+
+// lookup must be called with mu held
+func (r *Receiver) lookup(info *notification.Info) int {
+	for i, p := range r.pending {
+		if p.info == info || sameRecords(p.info, info) {
+			return i
+		}
+	}
+	return -1
+}
+
+func sameRecords(a, b *notification.Info) bool {
+	if len(a.Records) != len(b.Records) {
+		return false
+	}
+	for i := range a.Records {
+		if a.Records[i].S3.Object.Key != b.Records[i].S3.Object.Key ||
+			a.Records[i].S3.Object.Sequencer != b.Records[i].S3.Object.Sequencer {
+			return false
+		}
+	}
+	return true
+}
+
+// Begin is false if the request gave up while the notification waited in a lane, as MinIO will retry it
+func (r *Receiver) Begin(info *notification.Info) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.lookup(info)
+	return i != -1 && r.pending[i].gone.Err() == nil
+}
+
+func (r *Receiver) Ack(_ context.Context, result bucket.TransferResult, info *notification.Info) {
+	r.mu.Lock()
+	i := r.lookup(info)
+	if i == -1 {
+		r.mu.Unlock()
+		r.logger.Warn("Ack for a request that is no longer waiting", zap.Any("info", info))
+		return
+	}
+	p := r.pending[i]
+	r.removeAt(i)
+	r.mu.Unlock()
+	p.result <- result
+}
+
+func (r *Receiver) Pending() []bucket.PendingAck {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pending := make([]bucket.PendingAck, 0, len(r.pending))
+	for _, p := range r.pending {
+		keys := make([]string, 0, len(p.info.Records))
+		for _, record := range p.info.Records {
+			keys = append(keys, record.S3.Object.Key)
+		}
+		pending = append(pending, bucket.PendingAck{
+			Source:   p.remote,
+			Keys:     keys,
+			Received: p.received,
+		})
+	}
+	return pending
+}
+
+// Watcher takes notifications until ctx is done, then closes Uploads, and requests get 503 until the next Watcher.
+// It has no LastSeen, as MinIO only contacts us when there are uploads.
+func (r *Receiver) Watcher(ctx context.Context) *bucket.InboxWatcher {
+	run := &receiverRun{
+		uploads: make(chan notification.Info),
+		stop:    ctx.Done(),
+	}
+	r.mu.Lock()
+	r.run = run
+	r.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		r.mu.Lock()
+		if r.run == run {
+			r.run = nil
+		}
+		r.mu.Unlock()
+		// handlers that are sending see stop too
+		run.sending.Wait()
+		close(run.uploads)
+		r.logger.Info("Webhook receiver stopped taking notifications")
+	}()
+	return &bucket.InboxWatcher{
+		Uploads: run.uploads,
+		Ack:     r.Ack,
+		Pending: r.Pending,
+		Begin:   r.Begin,
+		Close: func(context.Context) {
+			r.logger.Info("Closing webhook receiver", zap.Int("waiting", len(r.Pending())))
+		},
+	}
+}
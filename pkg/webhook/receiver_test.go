@@ -0,0 +1,104 @@
+package webhook_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap/zaptest"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+	"repos.se/minio-deduplication/v2/pkg/kafka"
+	"repos.se/minio-deduplication/v2/pkg/webhook"
+)
+
+const testEvent = `{"EventName":"s3:ObjectCreated:Put","Key":"bucket.write/%s",` +
+	`"Records":[{"s3":{"bucket":{"name":"bucket.write"},"object":{"key":"%s","sequencer":"1"}}}]}`
+
+func TestReceiver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	receiver := webhook.NewReceiver(&webhook.ReceiverConfig{
+		Logger:     zaptest.NewLogger(t),
+		Token:      "t",
+		Filter:     kafka.MessageFilter{KeyPrefix: "bucket.write/"},
+		Registerer: prometheus.NewRegistry(),
+	})
+	mux := http.NewServeMux()
+	receiver.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	watcher := receiver.Watcher(ctx)
+
+	post := func(token string, body string) int {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+webhook.ReceiverPath, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	event := func(key string) string {
+		return strings.ReplaceAll(testEvent, "%s", key)
+	}
+
+	if status := post("wrong", event("a.txt")); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a bad token, got %d", status)
+	}
+	if status := post("t", `{"Key":"bucket.write/a.txt","Records":[]}`); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for zero records, got %d", status)
+	}
+	if status := post("t", `{"Key":`); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid JSON, got %d", status)
+	}
+	if status := post("t", strings.ReplaceAll(event("a.txt"), "bucket.write/", "other/")); status != http.StatusNoContent {
+		t.Errorf("Expected filtered events to succeed without transfer, got %d", status)
+	}
+
+	respond := func(result bucket.TransferResult) {
+		info := <-watcher.Uploads
+		if !watcher.Begin(&info) {
+			t.Error("Expected Begin while the request waits")
+		}
+		if len(watcher.Pending()) != 1 {
+			t.Errorf("Expected the request to be pending, got %v", watcher.Pending())
+		}
+		// a copy, like the one that went through the lanes
+		copied := notification.Info{Records: append([]notification.Event{}, info.Records...)}
+		watcher.Ack(ctx, result, &copied)
+	}
+	go respond(bucket.TransferOk)
+	if status := post("t", event("a.txt")); status != http.StatusNoContent {
+		t.Errorf("Expected 2xx after a successful transfer, got %d", status)
+	}
+	go respond(bucket.TransferFailed)
+	if status := post("t", event("b.txt")); status != http.StatusInternalServerError {
+		t.Errorf("Expected an error after a failed transfer, so that MinIO retries, got %d", status)
+	}
+	if len(watcher.Pending()) != 0 {
+		t.Errorf("Expected nothing pending, got %v", watcher.Pending())
+	}
+
+	cancel()
+	if _, open := <-watcher.Uploads; open {
+		t.Error("Expected Uploads to close when ctx is done")
+	}
+	if status := post("t", event("c.txt")); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 after stop, got %d", status)
+	}
+
+	// a re-run takes notifications through the same routes
+	rerun, cancelRerun := context.WithCancel(context.Background())
+	defer cancelRerun()
+	watcher = receiver.Watcher(rerun)
+	go respond(bucket.TransferOk)
+	if status := post("t", event("c.txt")); status != http.StatusNoContent {
+		t.Errorf("Expected the next watcher to take notifications, got %d", status)
+	}
+}
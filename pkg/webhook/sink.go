@@ -0,0 +1,295 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+)
+
+const (
+	SignatureHeader = "X-Deduplication-Signature"
+	DeliveryHeader  = "X-Deduplication-Delivery"
+	queueFileSuffix = ".json"
+)
+
+type SinkConfig struct {
+	Logger *zap.Logger
+	URL    string
+	// Secret signs request bodies with HMAC-SHA256, unsigned if empty
+	Secret []byte
+	// QueueDir is required, and persists events that are undelivered after MaxElapsed,
+	// as the notification is acked regardless
+	QueueDir string
+	// MaxElapsed is how long Publish retries before queueing
+	MaxElapsed time.Duration
+	// RetryInterval is how often the queue is retried
+	RetryInterval time.Duration
+	Client        *http.Client
+	// Registerer defaults to the prometheus default registry
+	Registerer prometheus.Registerer
+}
+
+// Sink POSTs transfer events to a webhook, with a persistent retry queue
+type Sink struct {
+	config *SinkConfig
+	logger *zap.Logger
+	// mu guards seq, queueLen and the check-then-enqueue, never a delivery, so that lanes don't wait for each other's retries
+	mu  sync.Mutex
+	seq int64
+	// queueLen is the number of files in QueueDir, read once at start
+	queueLen int
+	// draining is held by Drain, so that queued events are delivered once and in order
+	draining  sync.Mutex
+	delivered prometheus.Counter
+	failures  prometheus.Counter
+	dropped   prometheus.Counter
+	queued    prometheus.Gauge
+	latency   prometheus.Histogram
+}
+
+func NewSink(ctx context.Context, config *SinkConfig) *Sink {
+	logger := config.Logger
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if config.Registerer == nil {
+		config.Registerer = prometheus.DefaultRegisterer
+	}
+	metrics := promauto.With(config.Registerer)
+	s := &Sink{
+		config: config,
+		logger: logger,
+		delivered: metrics.NewCounter(prometheus.CounterOpts{
+			Name: "blobs_webhook_delivered",
+			Help: "Transfer events delivered to the webhook",
+		}),
+		failures: metrics.NewCounter(prometheus.CounterOpts{
+			Name: "blobs_webhook_attempt_failures",
+			Help: "Webhook delivery attempts that failed, excluding rejections",
+		}),
+		dropped: metrics.NewCounter(prometheus.CounterOpts{
+			Name: "blobs_webhook_dropped",
+			Help: "Transfer events that were rejected by the webhook",
+		}),
+		queued: metrics.NewGauge(prometheus.GaugeOpts{
+			Name: "blobs_webhook_queued",
+			Help: "Transfer events in the persistent retry queue",
+		}),
+		latency: metrics.NewHistogram(prometheus.HistogramOpts{
+			Name: "blobs_webhook_request_seconds",
+			Help: "Webhook request duration, including failed attempts",
+		}),
+	}
+	if config.QueueDir == "" {
+		logger.Fatal("Webhook requires a queue dir for undelivered events")
+	}
+	if err := os.MkdirAll(config.QueueDir, 0o755); err != nil {
+		logger.Fatal("Failed to create webhook queue dir", zap.String("dir", config.QueueDir), zap.Error(err))
+	}
+	s.queueLen = len(s.queue())
+	s.queued.Set(float64(s.queueLen))
+	go s.retryQueue(ctx)
+	logger.Info("Transfer events will be posted to webhook",
+		zap.String("url", config.URL),
+		zap.Bool("signed", len(config.Secret) > 0),
+		zap.String("queue", config.QueueDir),
+	)
+	return s
+}
+
+// RejectedError is a response that retries won't fix
+type RejectedError struct {
+	Status string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("webhook rejected the event: %s", e.Status)
+}
+
+// Sign returns the signature header value for a body
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Sink) post(ctx context.Context, delivery string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, delivery)
+	if len(s.config.Secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(s.config.Secret, body))
+	}
+	start := time.Now()
+	res, err := s.config.Client.Do(req)
+	s.latency.Observe(time.Since(start).Seconds())
+	if err != nil {
+		s.failures.Inc()
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	if res.StatusCode >= 400 && res.StatusCode < 500 &&
+		res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests {
+		return backoff.Permanent(&RejectedError{Status: res.Status})
+	}
+	s.failures.Inc()
+	return fmt.Errorf("webhook responded %s", res.Status)
+}
+
+// deliver retries with backoff for at most maxElapsed, zero meaning a single attempt
+func (s *Sink) deliver(ctx context.Context, delivery string, body []byte, maxElapsed time.Duration) error {
+	policy := backoff.NewExponentialBackOff()
+	policy.InitialInterval = time.Second / 4
+	policy.MaxElapsedTime = maxElapsed
+	var b backoff.BackOff = policy
+	if maxElapsed == 0 {
+		b = &backoff.StopBackOff{}
+	}
+	err := backoff.RetryNotify(
+		func() error { return s.post(ctx, delivery, body) },
+		backoff.WithContext(b, ctx),
+		func(err error, t time.Duration) {
+			s.logger.Warn("Webhook delivery failed", zap.String("delivery", delivery), zap.Duration("t", t), zap.Error(err))
+		},
+	)
+	if err == nil {
+		s.delivered.Inc()
+	}
+	return err
+}
+
+func (s *Sink) Publish(ctx context.Context, event *bucket.TransferEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.seq++
+	delivery := fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), s.seq%1000000)
+	// deliver in order, i.e. after anything that's already queued
+	if s.queueLen > 0 {
+		defer s.mu.Unlock()
+		return s.enqueue(delivery, body)
+	}
+	s.mu.Unlock()
+	err = s.deliver(ctx, delivery, body, s.config.MaxElapsed)
+	if err == nil {
+		return nil
+	}
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		s.logger.Error("Dropping undeliverable transfer event",
+			zap.String("delivery", delivery),
+			zap.String("upload", event.Upload),
+			zap.Error(err),
+		)
+		s.dropped.Inc()
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enqueue(delivery, body)
+}
+
+func (s *Sink) queue() []string {
+	entries, err := os.ReadDir(s.config.QueueDir)
+	if err != nil {
+		s.logger.Fatal("Failed to read webhook queue dir", zap.String("dir", s.config.QueueDir), zap.Error(err))
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), queueFileSuffix) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// enqueue must be called with mu held
+func (s *Sink) enqueue(delivery string, body []byte) error {
+	path := filepath.Join(s.config.QueueDir, delivery+queueFileSuffix)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, body, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	s.queueLen++
+	s.queued.Set(float64(s.queueLen))
+	s.logger.Info("Queued transfer event for webhook retry", zap.String("delivery", delivery))
+	return nil
+}
+
+// Drain attempts delivery of queued events in order, stopping at the first failure
+func (s *Sink) Drain(ctx context.Context) {
+	s.draining.Lock()
+	defer s.draining.Unlock()
+	// enqueue renames complete files into place, so listing needs no lock
+	names := s.queue()
+	for _, name := range names {
+		path := filepath.Join(s.config.QueueDir, name)
+		body, err := os.ReadFile(path)
+		if err != nil {
+			s.logger.Fatal("Failed to read queued webhook event", zap.String("path", path), zap.Error(err))
+		}
+		delivery := strings.TrimSuffix(name, queueFileSuffix)
+		err = s.deliver(ctx, delivery, body, 0)
+		var rejected *RejectedError
+		if errors.As(err, &rejected) {
+			s.logger.Error("Dropping queued transfer event", zap.String("delivery", delivery), zap.Error(err))
+			s.dropped.Inc()
+		} else if err != nil {
+			return
+		}
+		if err := os.Remove(path); err != nil {
+			s.logger.Fatal("Failed to remove delivered webhook event", zap.String("path", path), zap.Error(err))
+		}
+		s.mu.Lock()
+		s.queueLen--
+		s.queued.Set(float64(s.queueLen))
+		s.mu.Unlock()
+	}
+}
+
+func (s *Sink) retryQueue(ctx context.Context) {
+	interval := s.config.RetryInterval
+	if interval == 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Drain(ctx)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap/zaptest"
+	"repos.se/minio-deduplication/v2/pkg/bucket"
+	"repos.se/minio-deduplication/v2/pkg/webhook"
+)
+
+func TestSign(t *testing.T) {
+	sig := webhook.Sign([]byte("secret"), []byte(`{"outcome":"archived"}`))
+	if sig != "sha256=734f41a9acb0649eb95caf0d99d036fb5a35a1a8d3910952b71eca21d8e9af83" {
+		t.Errorf("Unexpected signature format %s", sig)
+	}
+	if sig != webhook.Sign([]byte("secret"), []byte(`{"outcome":"archived"}`)) {
+		t.Error("Signature should be deterministic")
+	}
+	if sig == webhook.Sign([]byte("other"), []byte(`{"outcome":"archived"}`)) {
+		t.Error("Signature should depend on secret")
+	}
+}
+
+func TestSinkRetryAndQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	status := http.StatusServiceUnavailable
+	var received []bucket.TransferEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(webhook.SignatureHeader) != webhook.Sign([]byte("s"), body) {
+			t.Errorf("Bad signature %s", r.Header.Get(webhook.SignatureHeader))
+		}
+		if r.Header.Get(webhook.DeliveryHeader) == "" {
+			t.Error("Missing delivery id")
+		}
+		if status == http.StatusOK {
+			var event bucket.TransferEvent
+			if err := json.Unmarshal(body, &event); err != nil {
+				t.Error(err)
+			}
+			received = append(received, event)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	sink := webhook.NewSink(ctx, &webhook.SinkConfig{
+		Logger:        zaptest.NewLogger(t),
+		URL:           server.URL,
+		Secret:        []byte("s"),
+		QueueDir:      dir,
+		MaxElapsed:    time.Millisecond * 300,
+		RetryInterval: time.Hour,
+		Registerer:    prometheus.NewRegistry(),
+	})
+
+	if err := sink.Publish(ctx, &bucket.TransferEvent{Outcome: bucket.OutcomeArchived, Upload: "a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Publish(ctx, &bucket.TransferEvent{Outcome: bucket.OutcomeDropped, Upload: "b.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	queued, _ := os.ReadDir(dir)
+	if len(queued) != 2 {
+		t.Errorf("Expected 2 queued events, got %d", len(queued))
+	}
+
+	status = http.StatusOK
+	sink.Drain(ctx)
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 delivered events, got %d", len(received))
+	}
+	if received[0].Upload != "a.txt" || received[1].Upload != "b.txt" {
+		t.Errorf("Expected queue order to be preserved, got %v", received)
+	}
+	queued, _ = os.ReadDir(dir)
+	if len(queued) != 0 {
+		t.Errorf("Expected empty queue after drain, got %d", len(queued))
+	}
+
+	if err := sink.Publish(ctx, &bucket.TransferEvent{Outcome: bucket.OutcomeArchived, Upload: "c.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 3 {
+		t.Errorf("Expected direct delivery with empty queue, got %d", len(received))
+	}
+
+	status = http.StatusBadRequest
+	if err := sink.Publish(ctx, &bucket.TransferEvent{Outcome: bucket.OutcomeArchived, Upload: "d.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	queued, _ = os.ReadDir(dir)
+	if len(queued) != 0 {
+		t.Errorf("Rejected events should not be queued, got %d", len(queued))
+	}
+}
+
+func TestSinkDeliversConcurrently(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event bucket.TransferEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		if event.Upload == "slow.txt" {
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	sink := webhook.NewSink(ctx, &webhook.SinkConfig{
+		Logger:     zaptest.NewLogger(t),
+		URL:        server.URL,
+		QueueDir:   t.TempDir(),
+		MaxElapsed: time.Second * 10,
+		Registerer: prometheus.NewRegistry(),
+	})
+	go sink.Publish(ctx, &bucket.TransferEvent{Outcome: bucket.OutcomeArchived, Upload: "slow.txt"})
+	time.Sleep(time.Millisecond * 50)
+
+	done := make(chan error)
+	go func() {
+		done <- sink.Publish(ctx, &bucket.TransferEvent{Outcome: bucket.OutcomeArchived, Upload: "fast.txt"})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Error("Expected a delivery not to wait for another that's in flight")
+	}
+}
+
+func TestSinkQueueFromPreviousRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event bucket.TransferEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		received = append(received, event.Upload)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000001-000001.json"), []byte(`{"upload":"a.txt"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sink := webhook.NewSink(ctx, &webhook.SinkConfig{
+		Logger:        zaptest.NewLogger(t),
+		URL:           server.URL,
+		QueueDir:      dir,
+		RetryInterval: time.Hour,
+		Registerer:    prometheus.NewRegistry(),
+	})
+	if err := sink.Publish(ctx, &bucket.TransferEvent{Outcome: bucket.OutcomeArchived, Upload: "b.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 0 {
+		t.Errorf("Expected the event to be queued behind the previous run's, got %v", received)
+	}
+	sink.Drain(ctx)
+	if len(received) != 2 || received[0] != "a.txt" || received[1] != "b.txt" {
+		t.Errorf("Expected queue order across runs, got %v", received)
+	}
+	if err := sink.Publish(ctx, &bucket.TransferEvent{Outcome: bucket.OutcomeArchived, Upload: "c.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 3 {
+		t.Errorf("Expected direct delivery once the queue is drained, got %v", received)
+	}
+}
@@ -10,7 +10,13 @@ echo "DOCKER_DEFAULT_PLATFORM=$DOCKER_DEFAULT_PLATFORM"
 for TEST in \
     "-f docker-compose.test.yml" \
     "-f docker-compose.test.yml -f docker-compose.test-kafka.yml" \
+    "-f docker-compose.test.yml -f docker-compose.test-nats.yml" \
+    "-f docker-compose.test.yml -f docker-compose.test-amqp.yml" \
+    "-f docker-compose.test.yml -f docker-compose.test-redis.yml" \
+    "-f docker-compose.test.yml -f docker-compose.test-webhook.yml" \
+    "-f docker-compose.test.yml -f docker-compose.test-polling.yml" \
     "-f docker-compose.test.yml -f docker-compose.test-batch.yml" \
+    "-f docker-compose.test.yml -f docker-compose.test-clamav.yml" \
     ; do
   echo "=> $TEST"
   TESTS_DISABLED=false docker-compose $TEST up --build --abort-on-container-exit --exit-code-from sut sut
@@ -17,6 +17,11 @@ mc ls -r minio0/bucket.write
 echo "_____ [after-all] topic contents  _____"
 rpk topic consume --brokers kafka:9092 minio-events -p 0 -o :end -f '%o %k %Vb\n' || true
 
+echo "_____ [after-all] results topic   _____"
+rpk topic consume --brokers kafka:9092 minio-deduplication-results -p 0 -o :end -f '%o %k %Vb\n' || true
+echo "_____ [after-all] dead letter topic _____"
+rpk topic consume --brokers kafka:9092 minio-deduplication-dlt -p 0 -o :end -f '%o %k %h %v\n' || true
+
 echo "_____ [after-all] consumer group  _____"
 rpk group list --brokers kafka:9092 || true
 rpk group describe --brokers kafka:9092 app0 || true
@@ -34,6 +34,7 @@ zero-padded-checksums.sh
 filename-encoding.sh
 upload-path-tracking.sh
 drop-empty.sh
+query-api.sh
 
 echo "_____ all tests executed _____"
 after-all.sh
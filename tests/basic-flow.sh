@@ -15,6 +15,14 @@ mc --no-color mb minio0/bucket.write
 
 mc event add minio0/bucket.write arn:minio:sqs::_:kafka --event put || \
   [ -z "$REQUIRE_KAFKA" ] || exit 1
+mc event add minio0/bucket.write arn:minio:sqs::_:nats --event put || \
+  [ -z "$REQUIRE_NATS" ] || exit 1
+mc event add minio0/bucket.write arn:minio:sqs::_:amqp --event put || \
+  [ -z "$REQUIRE_AMQP" ] || exit 1
+mc event add minio0/bucket.write arn:minio:sqs::_:webhook --event put || \
+  [ -z "$REQUIRE_WEBHOOK" ] || exit 1
+mc event add minio0/bucket.write arn:minio:sqs::_:redis --event put || \
+  [ -z "$REQUIRE_REDIS" ] || exit 1
 
 echo "Added before watch" > test1.txt
 mc --no-color cp --attr "Content-Type=text/testing1" test1.txt minio0/bucket.write/
@@ -48,6 +56,9 @@ curl -s http://app0:2112/metrics | grep 'blobs_'
 
 [ "$(curl -s http://app0:2112/metrics  | grep ^blobs_transfers_completed | cut -d' ' -f2)" = "2" ]
 
+curl -f -s http://app0:2112/healthz
+curl -f -s http://app0:2112/readyz
+
 echo "Upon successful transfers the write bucket should be empty"
 [ "$(mc --no-color ls minio0/bucket.write | wc -l)" = "0" ]
 
@@ -0,0 +1,20 @@
+#!/bin/bash
+set -eo pipefail
+[ -z "$DEBUG" ] || set -x
+
+name="query-api.txt"
+echo "Blob to query" > "$name"
+hash=$(sha256sum "$name" | cut -d' ' -f1)
+
+[ "$(curl -s -o /dev/null -w '%{http_code}' -I http://app0:2112/blobs/$hash)" = "404" ]
+
+mc --no-color cp "$name" "minio0/bucket.write/query/dir/$name"
+sleep $ACCEPTABLE_TRANSFER_DELAY
+
+curl -f -s -I http://app0:2112/blobs/$hash
+curl -f -s http://app0:2112/blobs/$hash | tee "$name.json"
+jq -e ".key == \"${hash:0:2}/${hash:2:2}/$hash.txt\"" "$name.json"
+jq -e '.uploads == ["query/dir/query-api.txt"]' "$name.json"
+
+curl -f -s "http://app0:2112/resolve?path=query%2Fdir%2F$name" | jq -e ".sha256 == \"$hash\""
+[ "$(curl -s -o /dev/null -w '%{http_code}' "http://app0:2112/resolve?path=query%2Fother.txt")" = "404" ]
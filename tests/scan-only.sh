@@ -0,0 +1,66 @@
+#!/bin/bash
+set -eEo pipefail
+
+[ "$TESTS_DISABLED" = "true" ] && echo "Tests disabled through env TESTS_DISABLED=true" && exit 0
+
+function onerr {
+  CALLER="$(caller)"
+  LINE=$1
+  echo "^^^^^ ERR $CALLER line $LINE ^^^^^"
+  after-all.sh || true
+  echo "_____ ERR $CALLER line $LINE _____"
+}
+
+trap 'onerr $LINENO' ERR
+
+echo "_____ scan test start _____"
+sleep 1
+
+[ -n "$RETRIES" ] || RETRIES=3
+
+curl -f --retry 3 --retry-connrefused http://app0:2112/metrics > /dev/null
+
+retrywait=0
+until mc --no-color config host add minio0 http://minio0:9000 $MINIO_ACCESS_KEY $MINIO_SECRET_KEY; \
+  do [ $(( retrywait++ )) -lt 30 ]; sleep 1; done
+
+mc --no-color mb minio0/bucket.write
+mc --no-color mb minio0/bucket.read
+mc --no-color mb minio0/bucket.quarantine
+
+echo "Clean upload" > clean.txt
+mc --no-color cp clean.txt minio0/bucket.write/partner/clean.txt
+# the EICAR test file, that every scanner detects but that isn't harmful
+echo 'X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*' > eicar.txt
+mc --no-color cp eicar.txt minio0/bucket.write/partner/eicar.txt
+
+hash=$(sha256sum clean.txt | cut -d' ' -f1)
+dir=${hash:0:2}/${hash:2:2}/
+expected=minio0/bucket.read/$dir$hash.txt
+retrywait=0
+until mc --no-color stat "$expected"; \
+  do [ $(( retrywait++ )) -lt $RETRIES ]; sleep $ACCEPTABLE_TRANSFER_DELAY; done
+mc --no-color stat --json "$expected" | jq '.'
+[ "$(mc --no-color stat --json "$expected" | jq -r '.metadata."X-Amz-Meta-Scan-Result"')" = "clean" ]
+mc --no-color stat --json "$expected" | jq -r '.metadata."X-Amz-Meta-Scan-Database"' | grep '^ClamAV '
+
+quarantined=minio0/bucket.quarantine/partner/eicar.txt
+retrywait=0
+until mc --no-color stat "$quarantined"; \
+  do [ $(( retrywait++ )) -lt $RETRIES ]; sleep $ACCEPTABLE_TRANSFER_DELAY; done
+mc --no-color stat --json "$quarantined" | jq '.'
+mc --no-color stat --json "$quarantined" | jq -r '.metadata."X-Amz-Meta-Scan-Result"' | grep '^infected '
+mc --no-color stat --json "$quarantined" | jq -r '.metadata."X-Amz-Meta-Quarantine-Reason"' | grep '^infected '
+
+hash=$(sha256sum eicar.txt | cut -d' ' -f1)
+dir=${hash:0:2}/${hash:2:2}/
+! mc --no-color stat minio0/bucket.read/$dir$hash.txt 2>/dev/null || false
+
+mc --no-color ls --summarize minio0/bucket.write | grep 'Total Objects: 0'
+
+curl -s http://app0:2112/metrics | grep 'blobs_scan_results{result="infected"} 1'
+curl -s http://app0:2112/metrics | grep 'blobs_scan_results{result="clean"} 1'
+
+echo "_____ scan test executed _____"
+after-all.sh
+echo "_____         ok         _____"